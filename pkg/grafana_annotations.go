@@ -0,0 +1,76 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// The columns of the tables of annotation scripts.
+const (
+	// annotationTimeColumn is the time of the annotations, time_ if the table
+	// doesn't have it.
+	annotationTimeColumn = "time"
+	// annotationTimeEndColumn is the end of region annotations, if any.
+	annotationTimeEndColumn = "timeEnd"
+	annotationTitleColumn   = "title"
+	annotationTextColumn    = "text"
+	// annotationTagsColumn holds the comma-separated tags of the annotations.
+	annotationTagsColumn = "tags"
+)
+
+// annotationFrame converts the table of an annotation script to the frame of
+// Grafana's annotations, with one annotation per row.
+func annotationFrame(frame *data.Frame) (*data.Frame, error) {
+	times := fieldByNames(frame, annotationTimeColumn, "time_")
+	if times == nil {
+		return nil, fmt.Errorf("annotation table %q has no %q column", frame.Name, annotationTimeColumn)
+	}
+	timeEnds := fieldByName(frame, annotationTimeEndColumn)
+	for _, field := range []*data.Field{times, timeEnds} {
+		if field != nil && !isTimeField(field) {
+			return nil, fmt.Errorf("column %q of annotation table %q is not a time", field.Name, frame.Name)
+		}
+	}
+	titles := fieldByName(frame, annotationTitleColumn)
+	texts := fieldByName(frame, annotationTextColumn)
+	if titles == nil && texts == nil {
+		return nil, fmt.Errorf("annotation table %q has no %q or %q column", frame.Name, annotationTitleColumn, annotationTextColumn)
+	}
+
+	numRows := times.Len()
+	// Rename the time field of time_ columns.
+	timeField := *times
+	timeField.Name = annotationTimeColumn
+	annotations := data.NewFrame(frame.Name, &timeField)
+	if timeEnds != nil {
+		annotations.Fields = append(annotations.Fields, timeEnds)
+	}
+	annotations.Fields = append(annotations.Fields,
+		renamedStringField(annotationTitleColumn, titles, numRows),
+		renamedStringField(annotationTextColumn, texts, numRows),
+		renamedStringField(annotationTagsColumn, fieldByName(frame, annotationTagsColumn), numRows),
+	)
+	if frame.Meta != nil {
+		annotations.Meta = &data.FrameMeta{Notices: frame.Meta.Notices}
+	}
+	return annotations, nil
+}
@@ -0,0 +1,78 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAnnotationFrame(t *testing.T) {
+	start := time.Unix(0, 0)
+	frame, err := annotationFrame(data.NewFrame("restarts",
+		data.NewField("time_", nil, []time.Time{start}),
+		data.NewField("timeEnd", nil, []time.Time{start.Add(time.Minute)}),
+		data.NewField("title", nil, []string{"Pod restarted"}),
+		data.NewField("restarts", nil, []int64{3}),
+	))
+	assert.Nil(t, err)
+
+	names := make([]string, len(frame.Fields))
+	for idx, field := range frame.Fields {
+		names[idx] = field.Name
+	}
+	assert.Equal(t, []string{"time", "timeEnd", "title", "text", "tags"}, names)
+	assert.Equal(t, start, frame.Fields[0].At(0))
+	assert.Equal(t, "Pod restarted", frame.Fields[2].At(0))
+	assert.Equal(t, "", frame.Fields[3].At(0))
+}
+
+func TestAnnotationFrameInvalidColumns(t *testing.T) {
+	start := time.Unix(0, 0)
+	tests := []struct {
+		name  string
+		frame *data.Frame
+	}{
+		{
+			name:  "no time",
+			frame: data.NewFrame("restarts", data.NewField("text", nil, []string{"Pod restarted"})),
+		},
+		{
+			name:  "no title or text",
+			frame: data.NewFrame("restarts", data.NewField("time", nil, []time.Time{start})),
+		},
+		{
+			name: "numeric end",
+			frame: data.NewFrame("restarts",
+				data.NewField("time", nil, []time.Time{start}),
+				data.NewField("timeEnd", nil, []int64{0}),
+				data.NewField("text", nil, []string{"Pod restarted"}),
+			),
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := annotationFrame(test.frame)
+			assert.NotNil(t, err)
+		})
+	}
+}
@@ -0,0 +1,94 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+
+	"px.dev/pxapi/proto/vizierpb"
+	"px.dev/pxapi/types"
+)
+
+// semanticDisplay describes how Grafana displays the columns of a Pixie semantic type.
+type semanticDisplay struct {
+	// unit is the Grafana unit of the column.
+	unit string
+	// decimals is the number of decimals shown, if set.
+	decimals *uint16
+	// perNanosecond marks rates per nanosecond. Grafana's rate units are per
+	// second, so the unit is only set when the values are converted.
+	perNanosecond bool
+}
+
+func decimals(d uint16) *uint16 {
+	return &d
+}
+
+// semanticDisplays maps the numeric Pixie semantic types to their display.
+var semanticDisplays = map[vizierpb.SemanticType]semanticDisplay{
+	vizierpb.ST_PERCENT:                 {unit: "percentunit", decimals: decimals(2)},
+	vizierpb.ST_DURATION_NS:             {unit: "ns"},
+	vizierpb.ST_BYTES:                   {unit: "bytes"},
+	vizierpb.ST_THROUGHPUT_PER_NS:       {unit: "reqps", decimals: decimals(2), perNanosecond: true},
+	vizierpb.ST_THROUGHPUT_BYTES_PER_NS: {unit: "Bps", perNanosecond: true},
+}
+
+// newFieldConfig returns the Grafana config of a column, or nil if its
+// semantic type doesn't need one. Rates per nanosecond only get a unit when
+// ratesPerSecond converts them.
+func newFieldConfig(col types.ColSchema, ratesPerSecond bool) *data.FieldConfig {
+	display, ok := semanticDisplays[col.SemanticType]
+	if !ok {
+		return nil
+	}
+	// Rates can only be converted to per second if the values are floats.
+	if display.perNanosecond && (!ratesPerSecond || col.Type != vizierpb.FLOAT64) {
+		return nil
+	}
+	return &data.FieldConfig{
+		Unit:     display.unit,
+		Decimals: display.decimals,
+	}
+}
+
+// convertRates converts the values of a rate column from per nanosecond to per
+// second, matching the unit set by newFieldConfig.
+func convertRates(col types.ColSchema, values []float64) {
+	display, ok := semanticDisplays[col.SemanticType]
+	if !ok || !display.perNanosecond {
+		return
+	}
+	for i := range values {
+		values[i] *= 1e9
+	}
+}
+
+// copyFieldConfigs sets the config of the fields of wideFrame to the config of
+// the field of longFrame with the same name, which data.LongToWide drops.
+func copyFieldConfigs(longFrame *data.Frame, wideFrame *data.Frame) {
+	configs := make(map[string]*data.FieldConfig)
+	for _, field := range longFrame.Fields {
+		configs[field.Name] = field.Config
+	}
+	for _, field := range wideFrame.Fields {
+		if config, ok := configs[field.Name]; ok && field.Config == nil {
+			field.Config = config
+		}
+	}
+}
@@ -0,0 +1,220 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// frameFormat is the shape of the frames of a query.
+type frameFormat string
+
+const (
+	// formatAuto converts tables with a time_ column to wide time series.
+	formatAuto frameFormat = "auto"
+	// formatTable keeps tables as they are.
+	formatTable frameFormat = "table"
+	// formatTimeSeriesLong returns long time series, with one row per time and labels.
+	formatTimeSeriesLong frameFormat = "time_series_long"
+	// formatTimeSeriesWide returns wide time series, with one field per value and labels.
+	formatTimeSeriesWide frameFormat = "time_series_wide"
+	// formatLogs returns log lines, with one frame per set of labels.
+	formatLogs frameFormat = "logs"
+)
+
+// fillModes maps the fill modes of queries to the modes of data.FillMissing.
+var fillModes = map[string]data.FillMode{
+	"null":     data.FillModeNull,
+	"previous": data.FillModePrevious,
+	"value":    data.FillModeValue,
+}
+
+// frameOptions controls how the tables of a query are shaped into frames.
+type frameOptions struct {
+	// Format is the shape of the frames. Empty means formatAuto.
+	Format frameFormat `json:"format"`
+	// TimeColumn is the time column of time series. Empty means the first time column.
+	TimeColumn string `json:"timeColumn"`
+	// LabelColumns are the columns of time series identifying a series, or the
+	// labels of log lines. Empty means every string and boolean column for time
+	// series, and no labels for logs.
+	LabelColumns []string `json:"labelColumns"`
+	// FillMode fills the missing values of wide time series. Empty means null.
+	FillMode string `json:"fillMode"`
+	// FillValue is the value of missing values when FillMode is value.
+	FillValue float64 `json:"fillValue"`
+	// BodyColumn is the body of log lines. Empty means the other columns
+	// formatted as key=value pairs.
+	BodyColumn string `json:"bodyColumn"`
+	// SeverityColumn is the column of the level of log lines, if any.
+	SeverityColumn string `json:"severityColumn"`
+	// RatesPerSecond converts the rates per nanosecond of throughput columns to
+	// rates per second, shown with Grafana's rate units.
+	RatesPerSecond bool `json:"ratesPerSecond"`
+	nodeGraphOptions
+}
+
+// validate checks that the options are supported.
+func (o frameOptions) validate() error {
+	switch o.Format {
+	case "", formatAuto, formatTable, formatTimeSeriesLong, formatTimeSeriesWide, formatLogs:
+	default:
+		return fmt.Errorf("unknown format %q", o.Format)
+	}
+	if _, ok := fillModes[o.FillMode]; o.FillMode != "" && !ok {
+		return fmt.Errorf("unknown fill mode %q", o.FillMode)
+	}
+	return nil
+}
+
+// fillMissing returns how the missing values of wide time series are filled.
+func (o frameOptions) fillMissing() *data.FillMissing {
+	mode, ok := fillModes[o.FillMode]
+	if !ok {
+		mode = data.FillModeNull
+	}
+	return &data.FillMissing{Mode: mode, Value: o.FillValue}
+}
+
+func isTimeField(field *data.Field) bool {
+	return field.Type() == data.FieldTypeTime || field.Type() == data.FieldTypeNullableTime
+}
+
+// hasTimeField returns whether frame has a time column.
+func hasTimeField(frame *data.Frame) bool {
+	for _, field := range frame.Fields {
+		if isTimeField(field) {
+			return true
+		}
+	}
+	return false
+}
+
+func isLabelField(field *data.Field) bool {
+	switch field.Type() {
+	case data.FieldTypeString, data.FieldTypeNullableString, data.FieldTypeBool, data.FieldTypeNullableBool:
+		return true
+	}
+	return false
+}
+
+// fieldByName returns the field of frame named name, or nil.
+func fieldByName(frame *data.Frame, name string) *data.Field {
+	for _, field := range frame.Fields {
+		if field.Name == name {
+			return field
+		}
+	}
+	return nil
+}
+
+// fieldByNames returns the first of the fields named names which is in frame, or
+// nil if there is none.
+func fieldByNames(frame *data.Frame, names ...string) *data.Field {
+	for _, name := range names {
+		if field := fieldByName(frame, name); field != nil {
+			return field
+		}
+	}
+	return nil
+}
+
+// stringField returns field with its values formatted as strings, so that
+// data.LongToWide uses it as a label.
+func stringField(field *data.Field) *data.Field {
+	if isLabelField(field) {
+		return field
+	}
+	values := make([]string, field.Len())
+	for i := range values {
+		if value, ok := field.ConcreteAt(i); ok {
+			values[i] = fmt.Sprint(value)
+		}
+	}
+	return data.NewField(field.Name, field.Labels, values)
+}
+
+// timeFieldIdx returns the index of the time field of frame: the time column
+// of options, or the first time field.
+func timeFieldIdx(frame *data.Frame, options frameOptions) (int, error) {
+	for idx, field := range frame.Fields {
+		if isTimeField(field) && (options.TimeColumn == "" || field.Name == options.TimeColumn) {
+			return idx, nil
+		}
+	}
+	if options.TimeColumn != "" {
+		return -1, fmt.Errorf("time column %q not found in table %q", options.TimeColumn, frame.Name)
+	}
+	return -1, fmt.Errorf("table %q has no time column", frame.Name)
+}
+
+// renamedStringField returns the values of field as strings in a field named
+// name, or empty strings if field is nil.
+func renamedStringField(name string, field *data.Field, numRows int) *data.Field {
+	values := make([]string, numRows)
+	if field != nil {
+		for i := range values {
+			if value, ok := field.ConcreteAt(i); ok {
+				values[i] = fmt.Sprint(value)
+			}
+		}
+	}
+	return data.NewField(name, nil, values)
+}
+
+// shapeTimeSeries returns a long time series frame made of the time column,
+// the label columns and the numeric columns of frame. Other columns, such as
+// other time columns, would be treated as values by Grafana and are dropped.
+func shapeTimeSeries(frame *data.Frame, options frameOptions) (*data.Frame, error) {
+	timeIdx, err := timeFieldIdx(frame, options)
+	if err != nil {
+		return nil, err
+	}
+
+	isLabel := make(map[string]bool)
+	for _, name := range options.LabelColumns {
+		isLabel[name] = true
+	}
+
+	shaped := data.NewFrame(frame.Name, frame.Fields[timeIdx])
+	shaped.Meta = frame.Meta
+	var values []*data.Field
+	for idx, field := range frame.Fields {
+		switch {
+		case idx == timeIdx || isTimeField(field):
+			continue
+		case len(options.LabelColumns) == 0 && isLabelField(field):
+			shaped.Fields = append(shaped.Fields, field)
+		case isLabel[field.Name]:
+			shaped.Fields = append(shaped.Fields, stringField(field))
+			delete(isLabel, field.Name)
+		case !isLabelField(field):
+			values = append(values, field)
+		}
+	}
+	for _, name := range options.LabelColumns {
+		if isLabel[name] {
+			return nil, fmt.Errorf("label column %q not found in table %q", name, frame.Name)
+		}
+	}
+	shaped.Fields = append(shaped.Fields, values...)
+	return shaped, nil
+}
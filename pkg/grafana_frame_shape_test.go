@@ -0,0 +1,85 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/assert"
+)
+
+// makeLatencyFrame returns a long frame of the latency of two services,
+// whose first time column isn't the time of the series.
+func makeLatencyFrame() *data.Frame {
+	start := time.Unix(0, 0)
+	return data.NewFrame("latency",
+		data.NewField("window_start", nil, []time.Time{start, start, start, start}),
+		data.NewField("timestamp", nil, []time.Time{start, start, start.Add(time.Second), start.Add(time.Second)}),
+		data.NewField("service", nil, []string{"cart", "checkout", "cart", "checkout"}),
+		data.NewField("pod", nil, []string{"cart-1", "checkout-1", "cart-1", "checkout-1"}),
+		data.NewField("port", nil, []int64{80, 443, 80, 443}),
+		data.NewField("latency", nil, []float64{1, 2, 3, 4}),
+	)
+}
+
+func TestShapeTimeSeries(t *testing.T) {
+	frame, err := shapeTimeSeries(makeLatencyFrame(), frameOptions{
+		TimeColumn:   "timestamp",
+		LabelColumns: []string{"service", "port"},
+	})
+	assert.Nil(t, err)
+
+	// The other time and string columns are dropped, the port is used as a label.
+	assert.Equal(t, 4, len(frame.Fields))
+	assert.Equal(t, "timestamp", frame.Fields[0].Name)
+	assert.Equal(t, "service", frame.Fields[1].Name)
+	assert.Equal(t, "port", frame.Fields[2].Name)
+	assert.Equal(t, "443", frame.Fields[2].At(1))
+	assert.Equal(t, "latency", frame.Fields[3].Name)
+	assert.Equal(t, data.TimeSeriesTypeLong, frame.TimeSeriesSchema().Type)
+
+	wideFrame, err := data.LongToWide(frame, frameOptions{}.fillMissing())
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(wideFrame.Fields))
+	assert.Equal(t, data.Labels{"service": "cart", "port": "80"}, wideFrame.Fields[1].Labels)
+}
+
+func TestShapeTimeSeriesErrors(t *testing.T) {
+	_, err := shapeTimeSeries(makeLatencyFrame(), frameOptions{TimeColumn: "time_"})
+	assert.NotNil(t, err)
+
+	_, err = shapeTimeSeries(makeLatencyFrame(), frameOptions{LabelColumns: []string{"namespace"}})
+	assert.NotNil(t, err)
+
+	_, err = shapeTimeSeries(data.NewFrame("no time", data.NewField("latency", nil, []float64{1})), frameOptions{})
+	assert.NotNil(t, err)
+}
+
+func TestFrameOptionsValidate(t *testing.T) {
+	assert.Nil(t, frameOptions{}.validate())
+	assert.Nil(t, frameOptions{Format: formatTimeSeriesWide, FillMode: "previous"}.validate())
+	assert.NotNil(t, frameOptions{Format: "heatmap"}.validate())
+	assert.NotNil(t, frameOptions{FillMode: "zero"}.validate())
+
+	fillMissing := frameOptions{FillMode: "value", FillValue: 0.5}.fillMissing()
+	assert.Equal(t, data.FillModeValue, fillMissing.Mode)
+	assert.Equal(t, 0.5, fillMissing.Value)
+}
@@ -0,0 +1,212 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// statusLevel maps an HTTP-like status code to the level of a log line.
+func statusLevel(status int64) string {
+	switch {
+	case status >= 500:
+		return "error"
+	case status >= 400:
+		return "warning"
+	}
+	return "info"
+}
+
+// logLevel returns the level of a log line from the value of its severity
+// column. Numbers are treated as status codes and strings used as they are.
+func logLevel(value interface{}) string {
+	switch v := value.(type) {
+	case int64:
+		return statusLevel(v)
+	case float64:
+		return statusLevel(int64(v))
+	}
+	return fmt.Sprint(value)
+}
+
+// logfmtValue formats the value of a column of a log line body.
+func logfmtValue(value interface{}) string {
+	var formatted string
+	switch v := value.(type) {
+	case time.Time:
+		formatted = v.Format(time.RFC3339Nano)
+	default:
+		formatted = fmt.Sprint(v)
+	}
+	if formatted == "" || strings.ContainsAny(formatted, " =\"\t\n") {
+		return strconv.Quote(formatted)
+	}
+	return formatted
+}
+
+// logfmtBodies returns log line bodies made of the key=value pairs of fields.
+func logfmtBodies(fields []*data.Field, numRows int) []string {
+	bodies := make([]string, numRows)
+	var body strings.Builder
+	for i := range bodies {
+		body.Reset()
+		for _, field := range fields {
+			value, ok := field.ConcreteAt(i)
+			if !ok {
+				continue
+			}
+			if body.Len() > 0 {
+				body.WriteByte(' ')
+			}
+			body.WriteString(field.Name)
+			body.WriteByte('=')
+			body.WriteString(logfmtValue(value))
+		}
+		bodies[i] = body.String()
+	}
+	return bodies
+}
+
+// subsetField returns the rows of field, in order.
+func subsetField(field *data.Field, rows []int) *data.Field {
+	subset := data.NewFieldFromFieldType(field.Type(), len(rows))
+	subset.Name = field.Name
+	subset.Config = field.Config
+	for i, row := range rows {
+		subset.Set(i, field.At(row))
+	}
+	return subset
+}
+
+// logStream is the rows of the log lines sharing a set of labels.
+type logStream struct {
+	labels data.Labels
+	rows   []int
+}
+
+// shapeLogs returns the log lines of frame, made of its time column, a body,
+// an optional level and the other columns, with a frame per set of labels.
+func shapeLogs(frame *data.Frame, options frameOptions) (data.Frames, error) {
+	timeIdx, err := timeFieldIdx(frame, options)
+	if err != nil {
+		return nil, err
+	}
+	timeField := frame.Fields[timeIdx]
+	numRows := timeField.Len()
+	isShaped := map[*data.Field]bool{timeField: true}
+
+	var bodyField, severityField *data.Field
+	if options.BodyColumn != "" {
+		if bodyField = fieldByName(frame, options.BodyColumn); bodyField == nil {
+			return nil, fmt.Errorf("body column %q not found in table %q", options.BodyColumn, frame.Name)
+		}
+		isShaped[bodyField] = true
+	}
+	if options.SeverityColumn != "" {
+		if severityField = fieldByName(frame, options.SeverityColumn); severityField == nil {
+			return nil, fmt.Errorf("severity column %q not found in table %q", options.SeverityColumn, frame.Name)
+		}
+		isShaped[severityField] = true
+	}
+	var labelFields []*data.Field
+	for _, name := range options.LabelColumns {
+		field := fieldByName(frame, name)
+		if field == nil {
+			return nil, fmt.Errorf("label column %q not found in table %q", name, frame.Name)
+		}
+		isShaped[field] = true
+		labelFields = append(labelFields, field)
+	}
+	var otherFields []*data.Field
+	for _, field := range frame.Fields {
+		if !isShaped[field] {
+			otherFields = append(otherFields, field)
+		}
+	}
+
+	// Without a body column, the body is made of the other columns.
+	var body *data.Field
+	if bodyField != nil {
+		body = data.NewField(bodyField.Name, nil, make([]string, numRows))
+		for i := 0; i < numRows; i++ {
+			if value, ok := bodyField.ConcreteAt(i); ok {
+				body.Set(i, fmt.Sprint(value))
+			}
+		}
+	} else {
+		body = data.NewField("body", nil, logfmtBodies(otherFields, numRows))
+		otherFields = nil
+	}
+	var levels *data.Field
+	if severityField != nil {
+		levels = data.NewField("level", nil, make([]string, numRows))
+		for i := 0; i < numRows; i++ {
+			if value, ok := severityField.ConcreteAt(i); ok {
+				levels.Set(i, logLevel(value))
+			}
+		}
+	}
+
+	// Group the log lines by labels, in order of appearance.
+	var streams []*logStream
+	streamsByLabels := make(map[string]*logStream)
+	for i := 0; i < numRows; i++ {
+		labels := make(data.Labels, len(labelFields))
+		for _, field := range labelFields {
+			value, _ := field.ConcreteAt(i)
+			labels[field.Name] = fmt.Sprint(value)
+		}
+		key := labels.String()
+		stream, ok := streamsByLabels[key]
+		if !ok {
+			stream = &logStream{labels: labels}
+			streamsByLabels[key] = stream
+			streams = append(streams, stream)
+		}
+		stream.rows = append(stream.rows, i)
+	}
+	if len(streams) == 0 {
+		streams = append(streams, &logStream{})
+	}
+
+	frames := make(data.Frames, 0, len(streams))
+	for _, stream := range streams {
+		streamFrame := data.NewFrame(frame.Name, subsetField(timeField, stream.rows), subsetField(body, stream.rows))
+		if len(stream.labels) > 0 {
+			streamFrame.Fields[1].Labels = stream.labels
+		}
+		if levels != nil {
+			streamFrame.Fields = append(streamFrame.Fields, subsetField(levels, stream.rows))
+		}
+		for _, field := range otherFields {
+			streamFrame.Fields = append(streamFrame.Fields, subsetField(field, stream.rows))
+		}
+		streamFrame.Meta = &data.FrameMeta{PreferredVisualization: data.VisTypeLogs}
+		if frame.Meta != nil {
+			streamFrame.Meta.Notices = frame.Meta.Notices
+		}
+		frames = append(frames, streamFrame)
+	}
+	return frames, nil
+}
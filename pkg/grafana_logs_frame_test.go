@@ -0,0 +1,75 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/assert"
+)
+
+func makeHTTPEventsFrame() *data.Frame {
+	start := time.Unix(0, 0)
+	return data.NewFrame("http_events",
+		data.NewField("time_", nil, []time.Time{start, start.Add(time.Second), start.Add(2 * time.Second)}),
+		data.NewField("service", nil, []string{"cart", "checkout", "cart"}),
+		data.NewField("req_path", nil, []string{"/cart", "/checkout", "/cart items"}),
+		data.NewField("resp_status", nil, []int64{200, 404, 503}),
+	)
+}
+
+func TestShapeLogs(t *testing.T) {
+	frames, err := shapeLogs(makeHTTPEventsFrame(), frameOptions{
+		LabelColumns:   []string{"service"},
+		SeverityColumn: "resp_status",
+	})
+	assert.Nil(t, err)
+
+	// A frame per service, whose body is made of the other columns.
+	assert.Equal(t, 2, len(frames))
+	cart := frames[0]
+	assert.Equal(t, data.VisType(data.VisTypeLogs), cart.Meta.PreferredVisualization)
+	assert.Equal(t, 3, len(cart.Fields))
+	assert.Equal(t, "body", cart.Fields[1].Name)
+	assert.Equal(t, data.Labels{"service": "cart"}, cart.Fields[1].Labels)
+	assert.Equal(t, `req_path="/cart items"`, cart.Fields[1].At(1))
+	assert.Equal(t, "level", cart.Fields[2].Name)
+	assert.Equal(t, "info", cart.Fields[2].At(0))
+	assert.Equal(t, "error", cart.Fields[2].At(1))
+	assert.Equal(t, "warning", frames[1].Fields[2].At(0))
+}
+
+func TestShapeLogsBodyColumn(t *testing.T) {
+	frames, err := shapeLogs(makeHTTPEventsFrame(), frameOptions{BodyColumn: "req_path"})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(frames))
+
+	// The other columns are kept as fields of the log lines.
+	assert.Equal(t, 4, len(frames[0].Fields))
+	assert.Equal(t, "req_path", frames[0].Fields[1].Name)
+	assert.Nil(t, frames[0].Fields[1].Labels)
+	assert.Equal(t, "service", frames[0].Fields[2].Name)
+
+	_, err = shapeLogs(makeHTTPEventsFrame(), frameOptions{BodyColumn: "message"})
+	assert.NotNil(t, err)
+	_, err = shapeLogs(makeHTTPEventsFrame(), frameOptions{SeverityColumn: "status"})
+	assert.NotNil(t, err)
+}
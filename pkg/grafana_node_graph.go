@@ -0,0 +1,193 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+const (
+	// defaultNodesTable is the table displayed as the nodes of a node graph.
+	defaultNodesTable = "nodes"
+	// defaultEdgesTable is the table displayed as the edges of a node graph.
+	defaultEdgesTable = "edges"
+)
+
+// nodeGraphOptions controls which tables of a query are node graph frames.
+type nodeGraphOptions struct {
+	// NodesTable is the table of the nodes of the graph. Empty means defaultNodesTable.
+	NodesTable string `json:"nodesTable"`
+	// EdgesTable is the table of the edges of the graph. Empty means defaultEdgesTable.
+	EdgesTable string `json:"edgesTable"`
+	// DeriveNodes adds the nodes of the graph from the sources and targets of
+	// the edges when the script doesn't display a nodes table.
+	DeriveNodes bool `json:"deriveNodes"`
+}
+
+func (o nodeGraphOptions) nodesTable() string {
+	if o.NodesTable == "" {
+		return defaultNodesTable
+	}
+	return o.NodesTable
+}
+
+func (o nodeGraphOptions) edgesTable() string {
+	if o.EdgesTable == "" {
+		return defaultEdgesTable
+	}
+	return o.EdgesTable
+}
+
+// isSet returns whether the query sets any of the options, in which case its
+// node graph tables must have the columns Grafana's node graph needs.
+func (o nodeGraphOptions) isSet() bool {
+	return o.NodesTable != "" || o.EdgesTable != "" || o.DeriveNodes
+}
+
+// requiredFields returns the columns Grafana's node graph needs in the table
+// name, or nil if it isn't a node graph table.
+func (o nodeGraphOptions) requiredFields(name string) []string {
+	switch name {
+	case o.nodesTable():
+		return []string{"id"}
+	case o.edgesTable():
+		return []string{"source", "target"}
+	}
+	return nil
+}
+
+// isNodeGraphFrame returns whether frame is displayed as the nodes or the
+// edges of a node graph, and thus isn't shaped into a time series. Without
+// node graph options, the default tables are only node graph tables if they
+// have the columns it needs.
+func (o nodeGraphOptions) isNodeGraphFrame(frame *data.Frame) bool {
+	fields := o.requiredFields(frame.Name)
+	if fields == nil {
+		return false
+	}
+	return o.isSet() || requireFields(frame, fields...) == nil
+}
+
+// requireFields checks that frame has a field for each name.
+func requireFields(frame *data.Frame, names ...string) error {
+	for _, name := range names {
+		if fieldByName(frame, name) == nil {
+			return fmt.Errorf("node graph table %q has no %q column", frame.Name, name)
+		}
+	}
+	return nil
+}
+
+// setNodeGraph marks frame to be displayed by Grafana's node graph.
+func setNodeGraph(frame *data.Frame) {
+	if frame.Meta == nil {
+		frame.Meta = &data.FrameMeta{}
+	}
+	frame.Meta.PreferredVisualization = data.VisTypeNodeGraph
+}
+
+// edgeIDField returns an id field of the edges, made of their source and
+// target, for edge tables which don't have one.
+func edgeIDField(sources *data.Field, targets *data.Field) *data.Field {
+	sources, targets = stringField(sources), stringField(targets)
+	ids := make([]string, sources.Len())
+	for i := range ids {
+		source, _ := sources.ConcreteAt(i)
+		target, _ := targets.ConcreteAt(i)
+		ids[i] = fmt.Sprintf("%v-%v", source, target)
+	}
+	return data.NewField("id", nil, ids)
+}
+
+// deriveNodesFrame returns a nodes frame with a node per source and target
+// of the edges, in order of appearance.
+func deriveNodesFrame(edges *data.Frame, name string) *data.Frame {
+	var ids []string
+	seen := make(map[string]bool)
+	for _, field := range []*data.Field{fieldByName(edges, "source"), fieldByName(edges, "target")} {
+		field = stringField(field)
+		for i := 0; i < field.Len(); i++ {
+			value, ok := field.ConcreteAt(i)
+			if !ok {
+				continue
+			}
+			id := fmt.Sprint(value)
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return data.NewFrame(name,
+		data.NewField("id", nil, ids),
+		data.NewField("title", nil, append([]string(nil), ids...)),
+	)
+}
+
+// nodeGraphFrames marks the nodes and edges frames for Grafana's node graph,
+// checking that they have the columns it needs. Without node graph options,
+// default tables missing columns are left as they are with a warning, since
+// they may be unrelated to node graphs. Edges without an id column get one,
+// and nodes are derived from the edges if requested.
+func nodeGraphFrames(frames data.Frames, options nodeGraphOptions) (data.Frames, error) {
+	var nodes, edges *data.Frame
+	for _, frame := range frames {
+		fields := options.requiredFields(frame.Name)
+		if fields == nil {
+			continue
+		}
+		if err := requireFields(frame, fields...); err != nil {
+			if options.isSet() {
+				return nil, err
+			}
+			frame.AppendNotices(data.Notice{
+				Severity: data.NoticeSeverityWarning,
+				Text:     fmt.Sprintf("%v, so it isn't displayed as a node graph", err),
+			})
+			continue
+		}
+		if frame.Name == options.nodesTable() {
+			nodes = frame
+		} else {
+			edges = frame
+		}
+	}
+
+	if nodes != nil {
+		setNodeGraph(nodes)
+	}
+	if edges == nil {
+		return frames, nil
+	}
+	if fieldByName(edges, "id") == nil {
+		id := edgeIDField(fieldByName(edges, "source"), fieldByName(edges, "target"))
+		edges.Fields = append([]*data.Field{id}, edges.Fields...)
+	}
+	setNodeGraph(edges)
+
+	if nodes == nil && options.DeriveNodes {
+		nodes = deriveNodesFrame(edges, options.nodesTable())
+		setNodeGraph(nodes)
+		frames = append(frames, nodes)
+	}
+	return frames, nil
+}
@@ -0,0 +1,104 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/assert"
+)
+
+func makeEdgesFrame(name string) *data.Frame {
+	return data.NewFrame(name,
+		data.NewField("source", nil, []string{"frontend", "frontend", "cart"}),
+		data.NewField("target", nil, []string{"cart", "catalog", "redis"}),
+		data.NewField("mainStat", nil, []float64{1, 2, 3}),
+	)
+}
+
+func TestNodeGraphFrames(t *testing.T) {
+	nodes := data.NewFrame("nodes", data.NewField("id", nil, []string{"frontend", "cart"}))
+	latency := makeLatencyFrame()
+	frames, err := nodeGraphFrames(data.Frames{latency, nodes, makeEdgesFrame("edges")}, nodeGraphOptions{DeriveNodes: true})
+	assert.Nil(t, err)
+
+	// The script's nodes are kept, the edges get an id.
+	assert.Equal(t, 3, len(frames))
+	assert.Nil(t, frames[0].Meta)
+	assert.Equal(t, data.VisType(data.VisTypeNodeGraph), frames[1].Meta.PreferredVisualization)
+	assert.Equal(t, 1, len(frames[1].Fields))
+	edges := frames[2]
+	assert.Equal(t, data.VisType(data.VisTypeNodeGraph), edges.Meta.PreferredVisualization)
+	assert.Equal(t, "id", edges.Fields[0].Name)
+	assert.Equal(t, "frontend-catalog", edges.Fields[0].At(1))
+}
+
+func TestNodeGraphFramesDeriveNodes(t *testing.T) {
+	options := nodeGraphOptions{EdgesTable: "service_map", DeriveNodes: true}
+	frames, err := nodeGraphFrames(data.Frames{makeEdgesFrame("service_map")}, options)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(frames))
+
+	nodes := frames[1]
+	assert.Equal(t, "nodes", nodes.Name)
+	assert.Equal(t, data.VisType(data.VisTypeNodeGraph), nodes.Meta.PreferredVisualization)
+	assert.Equal(t, "id", nodes.Fields[0].Name)
+	assert.Equal(t, "title", nodes.Fields[1].Name)
+	numRows, err := nodes.RowLen()
+	assert.Nil(t, err)
+	assert.Equal(t, 4, numRows)
+	assert.Equal(t, "catalog", nodes.Fields[0].At(2))
+
+	// Nodes are only derived if requested.
+	options.DeriveNodes = false
+	frames, err = nodeGraphFrames(data.Frames{makeEdgesFrame("service_map")}, options)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(frames))
+}
+
+func TestNodeGraphFramesMissingColumns(t *testing.T) {
+	nodes := data.NewFrame("nodes", data.NewField("title", nil, []string{"cart"}))
+	_, err := nodeGraphFrames(data.Frames{nodes}, nodeGraphOptions{NodesTable: "nodes"})
+	assert.NotNil(t, err)
+
+	edges := data.NewFrame("edges", data.NewField("source", nil, []string{"cart"}))
+	_, err = nodeGraphFrames(data.Frames{edges}, nodeGraphOptions{DeriveNodes: true})
+	assert.NotNil(t, err)
+}
+
+func TestNodeGraphFramesUnrelatedTables(t *testing.T) {
+	// Without node graph options, tables which happen to be named like the
+	// default node graph tables are left as plain tables.
+	nodes := data.NewFrame("nodes", data.NewField("hostname", nil, []string{"node-1"}))
+	edges := data.NewFrame("edges", data.NewField("source", nil, []string{"cart"}))
+	options := nodeGraphOptions{}
+	assert.False(t, options.isNodeGraphFrame(nodes))
+	assert.False(t, options.isNodeGraphFrame(edges))
+	assert.True(t, options.isNodeGraphFrame(makeEdgesFrame("edges")))
+
+	frames, err := nodeGraphFrames(data.Frames{nodes, edges}, options)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(frames))
+	for _, frame := range frames {
+		assert.Equal(t, data.VisType(""), frame.Meta.PreferredVisualization)
+		assert.Equal(t, data.NoticeSeverityWarning, frame.Meta.Notices[0].Severity)
+	}
+	assert.Equal(t, 1, len(frames[1].Fields))
+}
@@ -20,22 +20,84 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"sort"
+	"sync"
 	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	"px.dev/pxapi"
 	"px.dev/pxapi/proto/vizierpb"
 	"px.dev/pxapi/types"
 )
 
-type TableRow struct {
-	// rowVals are all the values in a row.
-	rowVals []interface{}
+// upid is the value of a UPID column, the unique ID of a process.
+type upid struct {
+	high uint64
+	low  uint64
 }
 
-type Table []TableRow
+// asid returns the ID of the agent on which the process runs.
+func (u upid) asid() uint32 {
+	return uint32(u.high >> 32)
+}
+
+// pid returns the process ID on its node.
+func (u upid) pid() uint32 {
+	return uint32(u.high)
+}
+
+// startTS returns the start time of the process, which tells apart processes
+// reusing the same PID.
+func (u upid) startTS() uint64 {
+	return u.low
+}
+
+// tableColumn holds the values of a table column, in the typed slice matching
+// the column's data type.
+type tableColumn struct {
+	bools    []bool
+	int64s   []int64
+	float64s []float64
+	strings  []string
+	times    []time.Time
+	// upids holds the raw values of expanded UPID columns, whose strings are in strings.
+	upids []upid
+}
+
+// permute reorders the column's values so that value i is the former value order[i].
+func (c *tableColumn) permute(order []int) {
+	if c.bools != nil {
+		c.bools = permuteSlice(c.bools, order)
+	}
+	if c.int64s != nil {
+		c.int64s = permuteSlice(c.int64s, order)
+	}
+	if c.float64s != nil {
+		c.float64s = permuteSlice(c.float64s, order)
+	}
+	if c.strings != nil {
+		c.strings = permuteSlice(c.strings, order)
+	}
+	if c.times != nil {
+		c.times = permuteSlice(c.times, order)
+	}
+	if c.upids != nil {
+		c.upids = permuteSlice(c.upids, order)
+	}
+}
+
+func permuteSlice[T any](values []T, order []int) []T {
+	permuted := make([]T, len(values))
+	for i, idx := range order {
+		permuted[i] = values[idx]
+	}
+	return permuted
+}
 
 // PixieToGrafanaTablePrinter satisfies the TableRecordHandler interface.
 type PixieToGrafanaTablePrinter struct {
@@ -44,8 +106,16 @@ type PixieToGrafanaTablePrinter struct {
 
 	metadata *types.TableMetadata
 
-	// Table holds the tables rows.
-	table Table
+	// columns holds the table's values as they are received, column by column.
+	columns []tableColumn
+	// numRows is the number of rows received.
+	numRows int
+	// numBytes is the estimated size of the rows received.
+	numBytes int
+	// truncation explains why the table was truncated, if it was.
+	truncation string
+	// mux is the muxer of the query the table belongs to.
+	mux *PixieToGrafanaTableMux
 
 	timeColIdx int
 }
@@ -70,117 +140,305 @@ func firstTimeColIdx(metadata types.TableMetadata) int {
 	return -1
 }
 
-// createNewFrame simply creates new frame based on the column names & types.
-func createNewFrame(metadata types.TableMetadata) *data.Frame {
-	// Create new data frame for new table.
-	frame := data.NewFrame(metadata.Name)
+// timeColIdx returns the index of the time column named name, or of the first
+// time column if there is no such column.
+func timeColIdx(metadata types.TableMetadata, name string) int {
+	for idx, col := range metadata.ColInfo {
+		if col.Type == vizierpb.TIME64NS && col.Name == name {
+			return idx
+		}
+	}
+	return firstTimeColIdx(metadata)
+}
 
-	// Create new fields (columns) for the frame.
-	for _, col := range metadata.ColInfo {
-		switch colType := col.Type; colType {
-		case vizierpb.BOOLEAN:
-			frame.Fields = append(frame.Fields,
-				data.NewField(col.Name, nil, []bool{}))
-		case vizierpb.INT64:
-			frame.Fields = append(frame.Fields,
-				data.NewField(col.Name, nil, []int64{}))
-		case vizierpb.TIME64NS:
-			frame.Fields = append(frame.Fields,
-				data.NewField(col.Name, nil, []time.Time{}))
-		case vizierpb.FLOAT64:
-			frame.Fields = append(frame.Fields,
-				data.NewField(col.Name, nil, []float64{}))
-		case vizierpb.STRING:
-			frame.Fields = append(frame.Fields,
-				data.NewField(col.Name, nil, []string{}))
-		case vizierpb.UINT128:
-			// Use a UUID style string representation for uint128
-			// since Grafana fields do not support uint128
-			frame.Fields = append(frame.Fields,
-				data.NewField(col.Name, nil, []string{}))
+// newColumnField creates the Grafana field of a column from its values.
+// It returns nil for columns of unsupported types.
+func newColumnField(col types.ColSchema, column tableColumn, ratesPerSecond bool) *data.Field {
+	var field *data.Field
+	switch col.Type {
+	case vizierpb.BOOLEAN:
+		field = data.NewField(col.Name, nil, column.bools)
+	case vizierpb.INT64:
+		field = data.NewField(col.Name, nil, column.int64s)
+	case vizierpb.TIME64NS:
+		field = data.NewField(col.Name, nil, column.times)
+	case vizierpb.FLOAT64:
+		if ratesPerSecond {
+			convertRates(col, column.float64s)
 		}
+		field = data.NewField(col.Name, nil, column.float64s)
+	case vizierpb.STRING, vizierpb.UINT128:
+		// Use a UUID style string representation for uint128
+		// since Grafana fields do not support uint128
+		field = data.NewField(col.Name, nil, column.strings)
+	default:
+		return nil
 	}
-	return frame
+	field.Config = newFieldConfig(col, ratesPerSecond)
+	return field
+}
+
+// newUPIDFields creates the fields derived from the UPIDs of a UPID column:
+// the agent ID, PID and start time of each process.
+func newUPIDFields(col types.ColSchema, column tableColumn) []*data.Field {
+	asids := make([]uint32, len(column.upids))
+	pids := make([]uint32, len(column.upids))
+	startTSs := make([]uint64, len(column.upids))
+	for i, u := range column.upids {
+		asids[i] = u.asid()
+		pids[i] = u.pid()
+		startTSs[i] = u.startTS()
+	}
+	return []*data.Field{
+		data.NewField(col.Name+"_asid", nil, asids),
+		data.NewField(col.Name+"_pid", nil, pids),
+		data.NewField(col.Name+"_start_ts", nil, startTSs),
+	}
+}
+
+// expandsUPIDs returns whether the agent ID, PID and start time of the UPIDs
+// of col are added as fields. Other UINT128 columns, such as UUIDs, aren't UPIDs.
+func (t *PixieToGrafanaTablePrinter) expandsUPIDs(col types.ColSchema) bool {
+	return t.mux != nil && t.mux.expandUPIDs && col.Type == vizierpb.UINT128 && col.SemanticType == vizierpb.ST_UPID
 }
 
-// HandleInit creates a new Grafana field for each column in a table.
+// HandleInit creates a typed column for each column in a table.
 func (t *PixieToGrafanaTablePrinter) HandleInit(ctx context.Context, metadata types.TableMetadata) error {
 	t.timeColIdx = firstTimeColIdx(metadata)
+	if t.mux != nil && t.mux.timeColumn != "" {
+		t.timeColIdx = timeColIdx(metadata, t.mux.timeColumn)
+	}
 	t.metadata = &metadata
+	t.columns = make([]tableColumn, len(metadata.ColInfo))
 	return nil
 }
 
-// HandleRecord goes through the record adding the data to the appropriate
-// field.
+// recordSize estimates the memory used by the values of a record.
+func recordSize(r *types.Record) int {
+	size := 0
+	for _, d := range r.Data {
+		switch d.Type() {
+		case vizierpb.BOOLEAN:
+			size++
+		case vizierpb.UINT128:
+			size += 16
+		case vizierpb.STRING:
+			size += len(d.(*types.StringValue).Value())
+		default:
+			size += 8
+		}
+	}
+	return size
+}
+
+// HandleRecord goes through the record appending each value to its column.
+// Records past the table's limits are dropped, and records past the query's
+// limits stop the script's execution.
 func (t *PixieToGrafanaTablePrinter) HandleRecord(ctx context.Context, r *types.Record) error {
-	rowTableData := TableRow{}
+	if t.truncation != "" {
+		return nil
+	}
+	size := recordSize(r)
+	if t.mux != nil {
+		if reason := t.mux.limits.exceedsTable(t.numRows+1, t.numBytes+size); reason != "" {
+			t.truncation = reason
+			return nil
+		}
+		if reason := t.mux.reserve(size); reason != "" {
+			t.truncation = reason
+			return errResultsTruncated
+		}
+	}
 
-	// Go through table row by row, appending to table data structure.
-	for _, d := range r.Data {
+	for colIdx, d := range r.Data {
+		if colIdx >= len(t.columns) {
+			break
+		}
+		column := &t.columns[colIdx]
 		switch d.Type() {
 		case vizierpb.BOOLEAN:
-			rowTableData.rowVals = append(rowTableData.rowVals, d.(*types.BooleanValue).Value())
+			column.bools = append(column.bools, d.(*types.BooleanValue).Value())
 		case vizierpb.INT64:
-			rowTableData.rowVals = append(rowTableData.rowVals, d.(*types.Int64Value).Value())
+			column.int64s = append(column.int64s, d.(*types.Int64Value).Value())
 		case vizierpb.UINT128:
-			rowTableData.rowVals = append(rowTableData.rowVals, d.(*types.UInt128Value).String())
+			value := d.(*types.UInt128Value)
+			column.strings = append(column.strings, value.String())
+			if t.expandsUPIDs(t.metadata.ColInfo[colIdx]) {
+				column.upids = append(column.upids, upid{high: value.Value().High, low: value.Value().Low})
+			}
 		case vizierpb.FLOAT64:
-			rowTableData.rowVals = append(rowTableData.rowVals, d.(*types.Float64Value).Value())
+			column.float64s = append(column.float64s, d.(*types.Float64Value).Value())
 		case vizierpb.STRING:
-			rowTableData.rowVals = append(rowTableData.rowVals, d.(*types.StringValue).Value())
+			column.strings = append(column.strings, d.(*types.StringValue).Value())
 		case vizierpb.TIME64NS:
-			rowTableData.rowVals = append(rowTableData.rowVals, d.(*types.Time64NSValue).Value())
+			column.times = append(column.times, d.(*types.Time64NSValue).Value())
 		}
 	}
-	t.table = append(t.table, rowTableData)
+	t.numRows++
+	t.numBytes += size
 	return nil
 }
 
 // HandleDone is run when all record processing is complete.
 func (t *PixieToGrafanaTablePrinter) HandleDone(ctx context.Context) error {
-	timeColIdx := t.timeColIdx
-
-	// Do sort using first time column.
+	// Do sort using first time column, reordering every column the same way.
 	if t.timeColIdx != -1 {
-		sort.Slice(t.table, func(i, j int) bool {
-			// Whichever time is earlier is the lesser.
-			firstTime := (t.table[i].rowVals[timeColIdx]).(time.Time)
-			secondTime := (t.table[j].rowVals[timeColIdx]).(time.Time)
-			return firstTime.Before(secondTime)
+		times := t.columns[t.timeColIdx].times
+		isSorted := sort.SliceIsSorted(times, func(i, j int) bool {
+			return times[i].Before(times[j])
 		})
+		if !isSorted {
+			_, span := tracer.Start(ctx, "sort table", trace.WithAttributes(
+				attribute.String("table", t.metadata.Name), attribute.Int("rows", len(times))))
+			order := make([]int, len(times))
+			for i := range order {
+				order[i] = i
+			}
+			sort.SliceStable(order, func(i, j int) bool {
+				// Whichever time is earlier is the lesser.
+				return times[order[i]].Before(times[order[j]])
+			})
+			for colIdx := range t.columns {
+				t.columns[colIdx].permute(order)
+			}
+			span.End()
+		}
 	}
 
-	// Create Grafana data frame, casting from interface type appropriately.
-	frame := createNewFrame(*t.metadata)
-	for _, tRow := range t.table {
-		for colIdx, rowVal := range tRow.rowVals {
-			switch rowValType := rowVal.(type) {
-			case bool:
-				frame.Fields[colIdx].Append(rowValType)
-			case int64:
-				frame.Fields[colIdx].Append(rowValType)
-			case time.Time:
-				frame.Fields[colIdx].Append(rowValType)
-			case string:
-				frame.Fields[colIdx].Append(rowValType)
-			case float64:
-				frame.Fields[colIdx].Append(rowValType)
-			}
+	// Create Grafana data frame from the columns.
+	frame := data.NewFrame(t.metadata.Name)
+	for colIdx, col := range t.metadata.ColInfo {
+		if field := newColumnField(col, t.columns[colIdx], t.mux != nil && t.mux.ratesPerSecond); field != nil {
+			frame.Fields = append(frame.Fields, field)
+		}
+		if t.expandsUPIDs(col) {
+			frame.Fields = append(frame.Fields, newUPIDFields(col, t.columns[colIdx])...)
 		}
 	}
+	if t.truncation != "" {
+		frame.AppendNotices(data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text:     fmt.Sprintf("Results were truncated to the first %d rows: %s.", t.numRows, t.truncation),
+		})
+	}
 	t.frame = frame
+	// The frame holds a copy of the values.
+	t.columns = nil
 	return nil
 }
 
+// errResultsTruncated stops the execution of a script whose results exceed the
+// query's limits.
+var errResultsTruncated = errors.New("results truncated")
+
+// resultLimits bounds the results of a query. Zero means unlimited.
+type resultLimits struct {
+	maxRowsPerTable  int
+	maxBytesPerTable int
+	maxRowsPerQuery  int
+	maxBytesPerQuery int
+}
+
+// exceedsTable returns why a table of numRows rows and numBytes bytes exceeds
+// the limits, or "" if it doesn't.
+func (l resultLimits) exceedsTable(numRows int, numBytes int) string {
+	if l.maxRowsPerTable > 0 && numRows > l.maxRowsPerTable {
+		return fmt.Sprintf("the table exceeded the limit of %d rows", l.maxRowsPerTable)
+	}
+	if l.maxBytesPerTable > 0 && numBytes > l.maxBytesPerTable {
+		return fmt.Sprintf("the table exceeded the limit of %d bytes", l.maxBytesPerTable)
+	}
+	return ""
+}
+
+// exceedsQuery returns why a query returning numRows rows and numBytes bytes
+// exceeds the limits, or "" if it doesn't.
+func (l resultLimits) exceedsQuery(numRows int, numBytes int) string {
+	if l.maxRowsPerQuery > 0 && numRows > l.maxRowsPerQuery {
+		return fmt.Sprintf("the query exceeded the limit of %d rows", l.maxRowsPerQuery)
+	}
+	if l.maxBytesPerQuery > 0 && numBytes > l.maxBytesPerQuery {
+		return fmt.Sprintf("the query exceeded the limit of %d bytes", l.maxBytesPerQuery)
+	}
+	return ""
+}
+
 // PixieToGrafanaTableMux satisfies the TableMuxer interface.
 type PixieToGrafanaTableMux struct {
 	// pxTablePrinterLst is a list of the table printers.
 	pxTablePrinterLst []*PixieToGrafanaTablePrinter
+	// limits bounds the results of the query.
+	limits resultLimits
+	// expandUPIDs adds the agent ID, PID and start time of UPID columns as fields.
+	expandUPIDs bool
+	// timeColumn is the column tables are sorted by. Empty means the first time column.
+	timeColumn string
+	// ratesPerSecond converts the rates per nanosecond of throughput columns to rates per second.
+	ratesPerSecond bool
+
+	// mu guards numRows, numBytes and truncation.
+	mu       sync.Mutex
+	numRows  int
+	numBytes int
+	// truncation explains why the query's results were truncated, if they were.
+	truncation string
 }
 
 // AcceptTable adds the table printer to the list of table printers.
 func (s *PixieToGrafanaTableMux) AcceptTable(ctx context.Context, metadata types.TableMetadata) (pxapi.TableRecordHandler, error) {
-	tablePrinter := &PixieToGrafanaTablePrinter{}
+	tablePrinter := &PixieToGrafanaTablePrinter{mux: s}
 	s.pxTablePrinterLst = append(s.pxTablePrinterLst, tablePrinter)
 	return tablePrinter, nil
 }
+
+// reserve adds a row of size bytes to the query's results. It returns why the
+// row exceeds the query's limits, or "" if it was added.
+func (s *PixieToGrafanaTableMux) reserve(size int) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.truncation == "" {
+		s.truncation = s.limits.exceedsQuery(s.numRows+1, s.numBytes+size)
+	}
+	if s.truncation != "" {
+		return s.truncation
+	}
+	s.numRows++
+	s.numBytes += size
+	return ""
+}
+
+// truncated returns whether the query's results were truncated.
+func (s *PixieToGrafanaTableMux) truncated() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.truncation != ""
+}
+
+// size returns the number of rows and the estimated size of the query's results.
+func (s *PixieToGrafanaTableMux) size() (int, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.numRows, s.numBytes
+}
+
+// finish creates the frames of the tables whose results were cut short,
+// e.g. when the query's limits stopped the script.
+func (s *PixieToGrafanaTableMux) finish(ctx context.Context) error {
+	s.mu.Lock()
+	truncation := s.truncation
+	s.mu.Unlock()
+
+	for _, tablePrinter := range s.pxTablePrinterLst {
+		if tablePrinter.frame != nil || tablePrinter.metadata == nil {
+			continue
+		}
+		if tablePrinter.truncation == "" {
+			tablePrinter.truncation = truncation
+		}
+		if err := tablePrinter.HandleDone(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
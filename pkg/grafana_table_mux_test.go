@@ -25,6 +25,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/grafana/grafana-plugin-sdk-go/data"
 	"github.com/stretchr/testify/assert"
 
 	"px.dev/pxapi/proto/vizierpb"
@@ -507,3 +508,259 @@ func TestTwoTables(t *testing.T) {
 		assert.Equal(t, val, expectedRowVal)
 	}
 }
+
+func TestSemanticTypeFieldConfig(t *testing.T) {
+	tableOneMetadata := makeTableMetadata(vizierpb.FLOAT64, vizierpb.INT64, vizierpb.FLOAT64, vizierpb.STRING)
+	tableOneMetadata.ColInfo[0].SemanticType = vizierpb.ST_PERCENT
+	tableOneMetadata.ColInfo[1].SemanticType = vizierpb.ST_DURATION_NS
+	tableOneMetadata.ColInfo[2].SemanticType = vizierpb.ST_THROUGHPUT_PER_NS
+	tableOneMetadata.ColInfo[3].SemanticType = vizierpb.ST_SERVICE_NAME
+
+	percentVal := types.NewFloat64Value(&tableOneMetadata.ColInfo[0])
+	percentVal.ScanFloat64(0.25)
+	latencyVal := types.NewInt64Value(&tableOneMetadata.ColInfo[1])
+	latencyVal.ScanInt64(1500000)
+	throughputVal := types.NewFloat64Value(&tableOneMetadata.ColInfo[2])
+	throughputVal.ScanFloat64(0.000000002)
+	serviceVal := types.NewStringValue(&tableOneMetadata.ColInfo[3])
+	serviceVal.ScanString("px-sock-shop/carts")
+
+	recordLst := []*types.Record{
+		{
+			Data:          []types.Datum{percentVal, latencyVal, throughputVal, serviceVal},
+			TableMetadata: tableOneMetadata,
+		},
+	}
+
+	tm := &PixieToGrafanaTableMux{}
+	tableMuxAcceptTableAndHandleRecord(t, tm, tableOneMetadata, recordLst)
+	grafanaFrame := tm.pxTablePrinterLst[0].frame
+
+	assert.Equal(t, "percentunit", grafanaFrame.Fields[0].Config.Unit)
+	assert.Equal(t, uint16(2), *grafanaFrame.Fields[0].Config.Decimals)
+	assert.Equal(t, 0.25, grafanaFrame.Fields[0].At(0).(float64))
+	assert.Equal(t, "ns", grafanaFrame.Fields[1].Config.Unit)
+	assert.Equal(t, int64(1500000), grafanaFrame.Fields[1].At(0).(int64))
+
+	// Rates per nanosecond are kept as they are by default.
+	assert.Nil(t, grafanaFrame.Fields[2].Config)
+	assert.Equal(t, 0.000000002, grafanaFrame.Fields[2].At(0).(float64))
+
+	assert.Nil(t, grafanaFrame.Fields[3].Config)
+
+	// With ratesPerSecond, rates per nanosecond are shown per second.
+	tm = &PixieToGrafanaTableMux{ratesPerSecond: true}
+	tableMuxAcceptTableAndHandleRecord(t, tm, tableOneMetadata, recordLst)
+	grafanaFrame = tm.pxTablePrinterLst[0].frame
+	assert.Equal(t, "reqps", grafanaFrame.Fields[2].Config.Unit)
+	assert.InDelta(t, 2.0, grafanaFrame.Fields[2].At(0).(float64), 1e-9)
+}
+
+// makeBenchmarkRecords returns numRows records of an http_events like table,
+// in reverse time order so that the printer has to sort them.
+func makeBenchmarkRecords(numRows int) (*types.TableMetadata, []*types.Record) {
+	metadata := makeTableMetadata(vizierpb.TIME64NS, vizierpb.STRING, vizierpb.INT64, vizierpb.FLOAT64)
+	now := time.Now()
+	recordLst := make([]*types.Record, numRows)
+	for idx := range recordLst {
+		timeVal := types.NewTime64NSValue(&metadata.ColInfo[0])
+		timeVal.ScanInt64(now.Add(-time.Duration(idx) * time.Millisecond).UnixNano())
+		stringVal := types.NewStringValue(&metadata.ColInfo[1])
+		stringVal.ScanString(fmt.Sprintf("/api/v1/items/%d", idx%100))
+		intVal := types.NewInt64Value(&metadata.ColInfo[2])
+		intVal.ScanInt64(int64(idx))
+		floatVal := types.NewFloat64Value(&metadata.ColInfo[3])
+		floatVal.ScanFloat64(float64(idx) / 3)
+		recordLst[idx] = &types.Record{
+			Data:          []types.Datum{timeVal, stringVal, intVal, floatVal},
+			TableMetadata: metadata,
+		}
+	}
+	return metadata, recordLst
+}
+
+func BenchmarkTablePrinter(b *testing.B) {
+	ctx := context.Background()
+	metadata, recordLst := makeBenchmarkRecords(100000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		tablePrinter := &PixieToGrafanaTablePrinter{}
+		if err := tablePrinter.HandleInit(ctx, *metadata); err != nil {
+			b.Fatal(err)
+		}
+		for _, record := range recordLst {
+			if err := tablePrinter.HandleRecord(ctx, record); err != nil {
+				b.Fatal(err)
+			}
+		}
+		if err := tablePrinter.HandleDone(ctx); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// rowAppendFrame builds the frame of a table the way the table printer did
+// before building columns: rows of boxed values are sorted by time, then
+// appended value by value to the fields. It is the baseline of
+// BenchmarkTablePrinter.
+func rowAppendFrame(metadata *types.TableMetadata, recordLst []*types.Record) *data.Frame {
+	timeColIdx := firstTimeColIdx(*metadata)
+	var rows [][]interface{}
+	for _, record := range recordLst {
+		var row []interface{}
+		for _, d := range record.Data {
+			switch d.Type() {
+			case vizierpb.INT64:
+				row = append(row, d.(*types.Int64Value).Value())
+			case vizierpb.FLOAT64:
+				row = append(row, d.(*types.Float64Value).Value())
+			case vizierpb.STRING:
+				row = append(row, d.(*types.StringValue).Value())
+			case vizierpb.TIME64NS:
+				row = append(row, d.(*types.Time64NSValue).Value())
+			}
+		}
+		rows = append(rows, row)
+	}
+	sort.Slice(rows, func(i, j int) bool {
+		return rows[i][timeColIdx].(time.Time).Before(rows[j][timeColIdx].(time.Time))
+	})
+
+	frame := data.NewFrame(metadata.Name)
+	for _, col := range metadata.ColInfo {
+		var field *data.Field
+		switch col.Type {
+		case vizierpb.INT64:
+			field = data.NewField(col.Name, nil, []int64{})
+		case vizierpb.FLOAT64:
+			field = data.NewField(col.Name, nil, []float64{})
+		case vizierpb.STRING:
+			field = data.NewField(col.Name, nil, []string{})
+		case vizierpb.TIME64NS:
+			field = data.NewField(col.Name, nil, []time.Time{})
+		}
+		field.Config = newFieldConfig(col, false)
+		frame.Fields = append(frame.Fields, field)
+	}
+	for _, row := range rows {
+		for colIdx, value := range row {
+			frame.Fields[colIdx].Append(value)
+		}
+	}
+	return frame
+}
+
+func BenchmarkTablePrinterRowAppend(b *testing.B) {
+	metadata, recordLst := makeBenchmarkRecords(100000)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rowAppendFrame(metadata, recordLst)
+	}
+}
+
+func TestRowAppendFrameMatchesTablePrinter(t *testing.T) {
+	metadata, recordLst := makeBenchmarkRecords(100)
+	tm := &PixieToGrafanaTableMux{}
+	tableMuxAcceptTableAndHandleRecord(t, tm, metadata, recordLst)
+
+	// The baseline builds the same frame, so the benchmarks compare the same work.
+	expected := rowAppendFrame(metadata, recordLst)
+	frame := tm.pxTablePrinterLst[0].frame
+	assert.Equal(t, len(expected.Fields), len(frame.Fields))
+	for colIdx := range expected.Fields {
+		assert.Equal(t, expected.Fields[colIdx].Len(), frame.Fields[colIdx].Len())
+		for rowIdx := 0; rowIdx < expected.Fields[colIdx].Len(); rowIdx++ {
+			assert.Equal(t, expected.Fields[colIdx].At(rowIdx), frame.Fields[colIdx].At(rowIdx))
+		}
+	}
+}
+
+func makeInt64Records(metadata *types.TableMetadata, numRows int) []*types.Record {
+	var recordLst []*types.Record
+	for idx := 0; idx < numRows; idx++ {
+		newInt64Val := types.NewInt64Value(&metadata.ColInfo[0])
+		newInt64Val.ScanInt64(int64(idx))
+		recordLst = append(recordLst, &types.Record{
+			Data:          []types.Datum{newInt64Val},
+			TableMetadata: metadata,
+		})
+	}
+	return recordLst
+}
+
+func TestTableRowLimit(t *testing.T) {
+	tableOneMetadata := makeTableMetadata(vizierpb.INT64)
+	tm := &PixieToGrafanaTableMux{limits: resultLimits{maxRowsPerTable: 2}}
+	tableMuxAcceptTableAndHandleRecord(t, tm, tableOneMetadata, makeInt64Records(tableOneMetadata, 5))
+
+	grafanaFrame := tm.pxTablePrinterLst[0].frame
+	assert.Equal(t, 2, grafanaFrame.Fields[0].Len())
+	assert.Equal(t, 1, len(grafanaFrame.Meta.Notices))
+	assert.Equal(t, data.NoticeSeverityWarning, grafanaFrame.Meta.Notices[0].Severity)
+	assert.False(t, tm.truncated())
+}
+
+func TestQueryByteLimit(t *testing.T) {
+	ctx := context.Background()
+	tableOneMetadata := makeTableMetadata(vizierpb.INT64)
+	tm := &PixieToGrafanaTableMux{limits: resultLimits{maxBytesPerQuery: 24}}
+
+	tableRecordHandler, err := tm.AcceptTable(ctx, *tableOneMetadata)
+	assert.Nil(t, err)
+	assert.Nil(t, tableRecordHandler.HandleInit(ctx, *tableOneMetadata))
+	var recordErr error
+	for _, record := range makeInt64Records(tableOneMetadata, 5) {
+		if recordErr = tableRecordHandler.HandleRecord(ctx, record); recordErr != nil {
+			break
+		}
+	}
+	// The script is stopped before the table is done.
+	assert.ErrorIs(t, recordErr, errResultsTruncated)
+	assert.True(t, tm.truncated())
+
+	assert.Nil(t, tm.finish(ctx))
+	grafanaFrame := tm.pxTablePrinterLst[0].frame
+	assert.Equal(t, 3, grafanaFrame.Fields[0].Len())
+	assert.Equal(t, 1, len(grafanaFrame.Meta.Notices))
+}
+
+func TestExpandUPIDs(t *testing.T) {
+	tableOneMetadata := makeTableMetadata(vizierpb.UINT128, vizierpb.UINT128)
+	tableOneMetadata.ColInfo[0].Name = "upid"
+	tableOneMetadata.ColInfo[0].SemanticType = vizierpb.ST_UPID
+	tableOneMetadata.ColInfo[1].Name = "trace_id"
+	newUInt128Val := types.NewUint128Value(&tableOneMetadata.ColInfo[0])
+	newUInt128Val.ScanUInt128(&vizierpb.UInt128{
+		High: 0x0000000700001234,
+		Low:  8123456,
+	})
+	traceIDVal := types.NewUint128Value(&tableOneMetadata.ColInfo[1])
+	traceIDVal.ScanUInt128(&vizierpb.UInt128{High: 1, Low: 2})
+
+	recordLst := []*types.Record{
+		{
+			Data:          []types.Datum{newUInt128Val, traceIDVal},
+			TableMetadata: tableOneMetadata,
+		},
+	}
+
+	tm := &PixieToGrafanaTableMux{expandUPIDs: true}
+	tableMuxAcceptTableAndHandleRecord(t, tm, tableOneMetadata, recordLst)
+	grafanaFrame := tm.pxTablePrinterLst[0].frame
+
+	// Only the UPID column is expanded, other UINT128 columns are kept as strings.
+	assert.Equal(t, 5, len(grafanaFrame.Fields))
+	assert.Equal(t, newUInt128Val.String(), grafanaFrame.Fields[0].At(0).(string))
+	assert.Equal(t, "upid_asid", grafanaFrame.Fields[1].Name)
+	assert.Equal(t, uint32(7), grafanaFrame.Fields[1].At(0).(uint32))
+	assert.Equal(t, "upid_pid", grafanaFrame.Fields[2].Name)
+	assert.Equal(t, uint32(0x1234), grafanaFrame.Fields[2].At(0).(uint32))
+	assert.Equal(t, "upid_start_ts", grafanaFrame.Fields[3].Name)
+	assert.Equal(t, uint64(8123456), grafanaFrame.Fields[3].At(0).(uint64))
+	assert.Equal(t, "trace_id", grafanaFrame.Fields[4].Name)
+	assert.Equal(t, traceIDVal.String(), grafanaFrame.Fields[4].At(0).(string))
+}
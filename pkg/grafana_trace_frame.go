@@ -0,0 +1,148 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// The columns of the tables of span scripts. Other columns are added to the
+// tags of the spans.
+const (
+	traceIDColumn      = "trace_id"
+	spanIDColumn       = "span_id"
+	parentSpanIDColumn = "parent_span_id"
+	serviceColumn      = "service"
+	operationColumn    = "operation"
+	// startTimeColumn is the start of the spans, time_ if the table doesn't have it.
+	startTimeColumn = "start_time"
+	// durationColumn is the duration of the spans in nanoseconds, latency if the
+	// table doesn't have it.
+	durationColumn = "duration"
+)
+
+// traceTag is a key-value pair of the tags of a span, as Grafana's trace view
+// expects them.
+type traceTag struct {
+	Key   string      `json:"key"`
+	Value interface{} `json:"value"`
+}
+
+// durationMs converts a duration in nanoseconds to milliseconds.
+func durationMs(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case int64:
+		return float64(v) / float64(time.Millisecond), nil
+	case uint64:
+		return float64(v) / float64(time.Millisecond), nil
+	case float64:
+		return v / float64(time.Millisecond), nil
+	}
+	return 0, fmt.Errorf("duration %v is not a number of nanoseconds", value)
+}
+
+// traceFrame converts the table of a span script to a frame shown by Grafana's
+// trace view, with one row per span.
+func traceFrame(frame *data.Frame) (*data.Frame, error) {
+	traceIDs := fieldByName(frame, traceIDColumn)
+	spanIDs := fieldByName(frame, spanIDColumn)
+	parentSpanIDs := fieldByName(frame, parentSpanIDColumn)
+	operations := fieldByName(frame, operationColumn)
+	services := fieldByName(frame, serviceColumn)
+	startTimes := fieldByNames(frame, startTimeColumn, "time_")
+	durations := fieldByNames(frame, durationColumn, "latency")
+
+	required := []struct {
+		name  string
+		field *data.Field
+	}{
+		{traceIDColumn, traceIDs},
+		{spanIDColumn, spanIDs},
+		{serviceColumn, services},
+		{startTimeColumn, startTimes},
+		{durationColumn, durations},
+	}
+	for _, column := range required {
+		if column.field == nil {
+			return nil, fmt.Errorf("span table %q has no %q column", frame.Name, column.name)
+		}
+	}
+	if !isTimeField(startTimes) {
+		return nil, fmt.Errorf("column %q of span table %q is not a time", startTimes.Name, frame.Name)
+	}
+
+	// The columns which aren't part of the span are its tags.
+	var tagFields []*data.Field
+	for _, field := range frame.Fields {
+		switch field {
+		case traceIDs, spanIDs, parentSpanIDs, operations, services, startTimes, durations:
+		default:
+			tagFields = append(tagFields, field)
+		}
+	}
+
+	numRows := startTimes.Len()
+	startTimeValues := make([]float64, numRows)
+	durationValues := make([]float64, numRows)
+	tags := make([]json.RawMessage, numRows)
+	for i := 0; i < numRows; i++ {
+		if startTime, ok := startTimes.ConcreteAt(i); ok {
+			startTimeValues[i] = float64(startTime.(time.Time).UnixNano()) / float64(time.Millisecond)
+		}
+		if duration, ok := durations.ConcreteAt(i); ok {
+			ms, err := durationMs(duration)
+			if err != nil {
+				return nil, fmt.Errorf("invalid span in table %q: %v", frame.Name, err)
+			}
+			durationValues[i] = ms
+		}
+		spanTags := make([]traceTag, 0, len(tagFields))
+		for _, field := range tagFields {
+			if value, ok := field.ConcreteAt(i); ok {
+				spanTags = append(spanTags, traceTag{Key: field.Name, Value: value})
+			}
+		}
+		encoded, err := json.Marshal(spanTags)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tags in span table %q: %v", frame.Name, err)
+		}
+		tags[i] = encoded
+	}
+
+	traces := data.NewFrame(frame.Name,
+		renamedStringField("traceID", traceIDs, numRows),
+		renamedStringField("spanID", spanIDs, numRows),
+		renamedStringField("parentSpanID", parentSpanIDs, numRows),
+		renamedStringField("operationName", operations, numRows),
+		renamedStringField("serviceName", services, numRows),
+		data.NewField("startTime", nil, startTimeValues),
+		data.NewField("duration", nil, durationValues),
+		data.NewField("tags", nil, tags),
+	)
+	traces.Meta = &data.FrameMeta{PreferredVisualization: data.VisTypeTrace}
+	if frame.Meta != nil {
+		// Keep the notices of truncated tables.
+		traces.Meta.Notices = frame.Meta.Notices
+	}
+	return traces, nil
+}
@@ -0,0 +1,77 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/assert"
+)
+
+func makeSpansFrame() *data.Frame {
+	start := time.Unix(1, 0)
+	return data.NewFrame("spans",
+		data.NewField("time_", nil, []time.Time{start, start.Add(time.Millisecond)}),
+		data.NewField("trace_id", nil, []string{"4bf92f35", "4bf92f35"}),
+		data.NewField("span_id", nil, []string{"00f067aa", "b7ad6b71"}),
+		data.NewField("parent_span_id", nil, []string{"", "00f067aa"}),
+		data.NewField("service", nil, []string{"frontend", "cart"}),
+		data.NewField("latency", nil, []int64{int64(5 * time.Millisecond), int64(2 * time.Millisecond)}),
+		data.NewField("resp_status", nil, []int64{200, 500}),
+	)
+}
+
+func TestTraceFrame(t *testing.T) {
+	frame, err := traceFrame(makeSpansFrame())
+	assert.Nil(t, err)
+	assert.Equal(t, data.VisType(data.VisTypeTrace), frame.Meta.PreferredVisualization)
+
+	names := make([]string, len(frame.Fields))
+	for idx, field := range frame.Fields {
+		names[idx] = field.Name
+	}
+	assert.Equal(t, []string{"traceID", "spanID", "parentSpanID", "operationName", "serviceName", "startTime", "duration", "tags"}, names)
+	assert.Equal(t, "00f067aa", frame.Fields[2].At(1))
+	assert.Equal(t, "", frame.Fields[3].At(1))
+	assert.Equal(t, "cart", frame.Fields[4].At(1))
+	assert.Equal(t, 1001.0, frame.Fields[5].At(1))
+	assert.Equal(t, 2.0, frame.Fields[6].At(1))
+
+	// The other columns are the tags of the spans.
+	var tags []traceTag
+	assert.Nil(t, json.Unmarshal(frame.Fields[7].At(1).(json.RawMessage), &tags))
+	assert.Equal(t, []traceTag{{Key: "resp_status", Value: 500.0}}, tags)
+}
+
+func TestTraceFrameMissingColumns(t *testing.T) {
+	for _, name := range []string{"trace_id", "span_id", "service", "time_", "latency"} {
+		frame := makeSpansFrame()
+		for idx, field := range frame.Fields {
+			if field.Name == name {
+				frame.Fields = append(frame.Fields[:idx], frame.Fields[idx+1:]...)
+				break
+			}
+		}
+		_, err := traceFrame(frame)
+		assert.NotNil(t, err, name)
+	}
+}
@@ -19,6 +19,8 @@
 package main
 
 import (
+	"context"
+	"fmt"
 	"os"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend/datasource"
@@ -26,8 +28,14 @@ import (
 )
 
 func main() {
-	err := datasource.Serve(createPixieDatasource())
+	shutdownTracing, err := setupTracing(context.Background())
+	if err != nil {
+		log.DefaultLogger.Error(fmt.Sprintf("Unable to set up tracing: %v", err))
+	} else {
+		defer shutdownTracing(context.Background())
+	}
 
+	err = datasource.Serve(createPixieDatasource())
 	if err != nil {
 		log.DefaultLogger.Error(err.Error())
 		os.Exit(1)
@@ -0,0 +1,180 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// cacheEntry is the cached response of a script.
+type cacheEntry struct {
+	key string
+	// frames are encoded with Arrow so every hit decodes its own copy, which
+	// the query can modify.
+	frames  [][]byte
+	size    int
+	expires time.Time
+}
+
+// queryCache caches the responses of scripts for a TTL, evicting the least
+// recently used responses once their size exceeds maxBytes.
+type queryCache struct {
+	ttl      time.Duration
+	maxBytes int
+
+	// mu guards size, entries and lru.
+	mu      sync.Mutex
+	size    int
+	entries map[string]*list.Element
+	// lru holds the entries, most recently used first.
+	lru *list.List
+}
+
+// newQueryCache creates an empty queryCache.
+func newQueryCache(ttl time.Duration, maxBytes int) *queryCache {
+	return &queryCache{
+		ttl:      ttl,
+		maxBytes: maxBytes,
+		entries:  make(map[string]*list.Element),
+		lru:      list.New(),
+	}
+}
+
+// bucket truncates the end of timeRange to a multiple of the TTL, keeping its
+// length, so the refreshes of a dashboard within a TTL run the same script and
+// share its response. Ranges shorter than the TTL don't become empty.
+func (c *queryCache) bucket(timeRange backend.TimeRange) backend.TimeRange {
+	to := timeRange.To.Truncate(c.ttl)
+	return backend.TimeRange{
+		From: to.Add(-timeRange.To.Sub(timeRange.From)),
+		To:   to,
+	}
+}
+
+// get returns a copy of the frames cached under key, if they haven't expired at now.
+func (c *queryCache) get(key string, now time.Time) (data.Frames, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if !now.Before(entry.expires) {
+		c.remove(elem)
+		return nil, false
+	}
+	frames, err := data.UnmarshalArrowFrames(entry.frames)
+	if err != nil {
+		c.remove(elem)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return frames, true
+}
+
+// set caches frames under key from now on. Frames larger than the cache
+// aren't cached.
+func (c *queryCache) set(key string, frames data.Frames, now time.Time) error {
+	encoded, err := frames.MarshalArrow()
+	if err != nil {
+		return err
+	}
+	size := len(key)
+	for _, frame := range encoded {
+		size += len(frame)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	if size > c.maxBytes {
+		return nil
+	}
+	for c.size+size > c.maxBytes {
+		c.remove(c.lru.Back())
+	}
+	entry := &cacheEntry{key: key, frames: encoded, size: size, expires: now.Add(c.ttl)}
+	c.entries[key] = c.lru.PushFront(entry)
+	c.size += size
+	return nil
+}
+
+// remove drops the entry of elem. c.mu must be held.
+func (c *queryCache) remove(elem *list.Element) {
+	entry := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, entry.key)
+	c.size -= entry.size
+}
+
+// clear drops every entry.
+func (c *queryCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.size = 0
+	c.entries = make(map[string]*list.Element)
+	c.lru.Init()
+}
+
+// hashKey returns a key made of parts.
+func hashKey(parts ...string) string {
+	hash := sha256.New()
+	for _, part := range parts {
+		hash.Write([]byte(part))
+		hash.Write([]byte{0})
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// scriptKey returns the key of the executions of the rendered pxlScript on
+// clusterID by queries of the type of qp, whose frames are shaped with the
+// options of qp.
+func (qp PixieQueryProcessor) scriptKey(pxlScript string, clusterID string) (string, error) {
+	options, err := json.Marshal(qp.frameOptions)
+	if err != nil {
+		return "", err
+	}
+	return hashKey(string(qp.queryType), clusterID, pxlScript, string(options),
+		strconv.FormatBool(qp.expandUPIDs), strconv.FormatBool(qp.alerting)), nil
+}
+
+// cacheKey returns the key of the response of the rendered pxlScript on
+// clusterID over timeRange, shaped with the options of qp.
+func (qp PixieQueryProcessor) cacheKey(pxlScript string, clusterID string, timeRange backend.TimeRange) (string, error) {
+	scriptKey, err := qp.scriptKey(pxlScript, clusterID)
+	if err != nil {
+		return "", err
+	}
+	return hashKey(scriptKey,
+		strconv.FormatInt(timeRange.From.UnixNano(), 10), strconv.FormatInt(timeRange.To.UnixNano(), 10)), nil
+}
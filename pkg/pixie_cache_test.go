@@ -0,0 +1,114 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueryCacheBucket(t *testing.T) {
+	cache := newQueryCache(30*time.Second, 1<<20)
+	start := time.Unix(1000, 0)
+	// Refreshes 10 s apart fall in the same bucket until the TTL elapses.
+	first := cache.bucket(backend.TimeRange{From: start.Add(-15 * time.Minute), To: start})
+	second := cache.bucket(backend.TimeRange{From: start.Add(-15*time.Minute + 10*time.Second), To: start.Add(10 * time.Second)})
+	third := cache.bucket(backend.TimeRange{From: start.Add(-15*time.Minute + 20*time.Second), To: start.Add(20 * time.Second)})
+	assert.Equal(t, first, second)
+	assert.NotEqual(t, first, third)
+	assert.Equal(t, time.Unix(990, 0), first.To)
+	assert.Equal(t, 15*time.Minute, first.To.Sub(first.From))
+
+	// Ranges shorter than the TTL keep their length.
+	short := cache.bucket(backend.TimeRange{From: start.Add(5 * time.Second), To: start.Add(15 * time.Second)})
+	assert.Equal(t, time.Unix(990, 0), short.To)
+	assert.Equal(t, 10*time.Second, short.To.Sub(short.From))
+}
+
+func TestQueryCacheGetSet(t *testing.T) {
+	cache := newQueryCache(30*time.Second, 1<<20)
+	now := time.Unix(1000, 0)
+	_, ok := cache.get("key", now)
+	assert.False(t, ok)
+
+	assert.Nil(t, cache.set("key", data.Frames{makeHTTPEventsFrame()}, now))
+	frames, ok := cache.get("key", now.Add(29*time.Second))
+	assert.True(t, ok)
+	assert.Equal(t, 1, len(frames))
+	assert.Equal(t, "http_events", frames[0].Name)
+	assert.Equal(t, "checkout", frames[0].Fields[1].At(1))
+
+	// Hits return copies of the cached frames.
+	frames[0].Fields[1].Set(1, "cart")
+	frames, _ = cache.get("key", now)
+	assert.Equal(t, "checkout", frames[0].Fields[1].At(1))
+
+	// Responses expire after the TTL.
+	_, ok = cache.get("key", now.Add(30*time.Second))
+	assert.False(t, ok)
+	assert.Equal(t, 0, cache.size)
+}
+
+func TestQueryCacheEviction(t *testing.T) {
+	now := time.Unix(1000, 0)
+	frames := data.Frames{makeHTTPEventsFrame()}
+	encoded, err := frames.MarshalArrow()
+	assert.Nil(t, err)
+	// Room for two responses.
+	cache := newQueryCache(time.Minute, 2*(len(encoded[0])+len("a")))
+
+	assert.Nil(t, cache.set("a", frames, now))
+	assert.Nil(t, cache.set("b", frames, now))
+	_, ok := cache.get("a", now)
+	assert.True(t, ok)
+	// The least recently used response makes room for the new one.
+	assert.Nil(t, cache.set("c", frames, now))
+	_, ok = cache.get("b", now)
+	assert.False(t, ok)
+	_, ok = cache.get("a", now)
+	assert.True(t, ok)
+	_, ok = cache.get("c", now)
+	assert.True(t, ok)
+
+	// Responses larger than the cache aren't cached.
+	small := newQueryCache(time.Minute, 10)
+	assert.Nil(t, small.set("a", frames, now))
+	_, ok = small.get("a", now)
+	assert.False(t, ok)
+}
+
+func TestCacheKey(t *testing.T) {
+	timeRange := backend.TimeRange{From: time.Unix(0, 0), To: time.Unix(60, 0)}
+	qp := PixieQueryProcessor{}
+	key, err := qp.cacheKey("px.display(df)", "cluster-a", timeRange)
+	assert.Nil(t, err)
+
+	same, _ := qp.cacheKey("px.display(df)", "cluster-a", timeRange)
+	assert.Equal(t, key, same)
+	otherCluster, _ := qp.cacheKey("px.display(df)", "cluster-b", timeRange)
+	assert.NotEqual(t, key, otherCluster)
+	otherRange, _ := qp.cacheKey("px.display(df)", "cluster-a", backend.TimeRange{From: timeRange.From, To: time.Unix(90, 0)})
+	assert.NotEqual(t, key, otherRange)
+	otherFormat, _ := PixieQueryProcessor{frameOptions: frameOptions{Format: formatTable}}.cacheKey("px.display(df)", "cluster-a", timeRange)
+	assert.NotEqual(t, key, otherFormat)
+}
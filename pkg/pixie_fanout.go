@@ -0,0 +1,181 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+
+	"px.dev/pxapi"
+)
+
+const (
+	// allClusters in the cluster IDs of a query runs it on every connected cluster.
+	allClusters = "all"
+	// clusterLabel is the label or column of the cluster of fan-out query results.
+	clusterLabel = "cluster"
+)
+
+// selectClusters returns the IDs of the clusters of clusterIDs, replacing
+// allClusters with the connected clusters, without duplicates or unresolved
+// dashboard variables.
+func selectClusters(clusterIDs []string, viziers []*pxapi.VizierInfo) []string {
+	var selected []string
+	seen := make(map[string]bool)
+	add := func(clusterID string) {
+		if clusterID != "" && !seen[clusterID] {
+			seen[clusterID] = true
+			selected = append(selected, clusterID)
+		}
+	}
+	for _, clusterID := range clusterIDs {
+		clusterID = strings.TrimSpace(clusterID)
+		if strings.HasPrefix(clusterID, "$") {
+			// Dashboard variables aren't interpolated in alert rules.
+			continue
+		}
+		if clusterID != allClusters {
+			add(clusterID)
+			continue
+		}
+		for _, vizier := range viziers {
+			if vizier.Status != pxapi.VizierStatusDisconnected {
+				add(vizier.ID)
+			}
+		}
+	}
+	return selected
+}
+
+// addClusterLabel marks the results of frame as coming from cluster: the value
+// fields of wide time series get a cluster label, other frames a cluster column.
+func addClusterLabel(frame *data.Frame, cluster string) {
+	if fieldByName(frame, clusterLabel) != nil {
+		return
+	}
+	if len(frame.Fields) > 0 && frame.TimeSeriesSchema().Type == data.TimeSeriesTypeWide {
+		for _, field := range frame.Fields {
+			if isTimeField(field) {
+				continue
+			}
+			if field.Labels == nil {
+				field.Labels = data.Labels{}
+			}
+			field.Labels[clusterLabel] = cluster
+		}
+		return
+	}
+	clusters := make([]string, frame.Rows())
+	for i := range clusters {
+		clusters[i] = cluster
+	}
+	frame.Fields = append(frame.Fields, data.NewField(clusterLabel, nil, clusters))
+}
+
+// queryFanOut runs the query on each of its clusters concurrently, and merges
+// their frames, labeled with the name of their cluster. Clusters on which the
+// query fails are reported in a notice, unless it fails on all of them. If no
+// cluster is selected, the query runs on the cluster of resolveClusterID.
+func (td *PixieDatasource) queryFanOut(ctx context.Context, qp PixieQueryProcessor, qm queryModel,
+	query backend.DataQuery) (*backend.DataResponse, error) {
+
+	client, err := qp.instance.getClient(ctx)
+	if err != nil {
+		return nil, newQueryError(statusUnavailable, "error creating Pixie Client: %v", err)
+	}
+	viziers, err := client.ListViziers(ctx)
+	if err != nil {
+		return nil, newQueryError(statusUnavailable, "Error with getting viziers: %s", err)
+	}
+	clusterIDs := selectClusters(qm.QueryBody.ClusterIDs, viziers)
+	if len(clusterIDs) == 0 {
+		// The selected clusters may all be dashboard variables, which alert
+		// rules don't interpolate, so the query runs on its own cluster.
+		clusterID := resolveClusterID(qm, qp.instance.settings)
+		if clusterID == "" {
+			return nil, newQueryError(statusBadRequest, "no connected cluster to run the query on")
+		}
+		return td.runQuery(ctx, qp, qm, query, clusterID)
+	}
+	names := make(map[string]string)
+	for _, vizier := range viziers {
+		names[vizier.ID] = vizier.Name
+	}
+
+	responses := make([]*backend.DataResponse, len(clusterIDs))
+	errs := make([]error, len(clusterIDs))
+	// Like the queries of a request, at most maxConcurrentQueries clusters are
+	// queried at a time.
+	sem := make(chan struct{}, qp.instance.settings.MaxConcurrentQueries)
+	var wg sync.WaitGroup
+	for idx, clusterID := range clusterIDs {
+		wg.Add(1)
+		go func(idx int, clusterID string) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			responses[idx], errs[idx] = td.runQuery(ctx, qp, qm, query, clusterID)
+		}(idx, clusterID)
+	}
+	wg.Wait()
+
+	merged := &backend.DataResponse{}
+	var failures []string
+	var firstErr error
+	for idx, clusterID := range clusterIDs {
+		cluster := clusterID
+		if name, ok := names[clusterID]; ok && name != "" {
+			cluster = name
+		}
+		err := errs[idx]
+		if err == nil && responses[idx].Error != nil {
+			err = responses[idx].Error
+		}
+		if err != nil {
+			log.DefaultLogger.Warn(fmt.Sprintf("Query %s failed on cluster %s: %v", query.RefID, cluster, err))
+			failures = append(failures, fmt.Sprintf("%s: %v", cluster, err))
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+		if responses[idx] == nil {
+			continue
+		}
+		for _, frame := range responses[idx].Frames {
+			addClusterLabel(frame, cluster)
+			merged.Frames = append(merged.Frames, frame)
+		}
+	}
+	if len(failures) == len(clusterIDs) {
+		return nil, firstErr
+	}
+	if len(failures) > 0 && len(merged.Frames) > 0 {
+		merged.Frames[0].AppendNotices(data.Notice{
+			Severity: data.NoticeSeverityWarning,
+			Text:     fmt.Sprintf("The query failed on some clusters: %s.", strings.Join(failures, "; ")),
+		})
+	}
+	return merged, nil
+}
@@ -0,0 +1,130 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/assert"
+
+	"px.dev/pxapi"
+)
+
+func TestSelectClusters(t *testing.T) {
+	viziers := []*pxapi.VizierInfo{
+		{ID: "staging", Status: pxapi.VizierStatusHealthy},
+		{ID: "production", Status: pxapi.VizierStatusUnhealthy},
+		{ID: "old", Status: pxapi.VizierStatusDisconnected},
+	}
+	assert.Equal(t, []string{"staging", "production"}, selectClusters([]string{"all"}, viziers))
+	assert.Equal(t, []string{"production", "staging"}, selectClusters([]string{" production", "", "all"}, viziers))
+	assert.Equal(t, []string{"old"}, selectClusters([]string{"old", "old"}, viziers))
+	assert.Nil(t, selectClusters([]string{"all"}, nil))
+	assert.Equal(t, []string{"staging"}, selectClusters([]string{"$pixieCluster", "staging"}, viziers))
+}
+
+func TestAddClusterLabel(t *testing.T) {
+	start := time.Unix(0, 0)
+	wideFrame := data.NewFrame("latency",
+		data.NewField("time_", nil, []time.Time{start}),
+		data.NewField("latency", data.Labels{"service": "cart"}, []float64{1}),
+	)
+	addClusterLabel(wideFrame, "staging")
+	assert.Equal(t, 2, len(wideFrame.Fields))
+	assert.Equal(t, data.Labels{"service": "cart", "cluster": "staging"}, wideFrame.Fields[1].Labels)
+
+	table := data.NewFrame("services", data.NewField("service", nil, []string{"cart", "checkout"}))
+	addClusterLabel(table, "staging")
+	assert.Equal(t, 2, len(table.Fields))
+	assert.Equal(t, "cluster", table.Fields[1].Name)
+	assert.Equal(t, "staging", table.Fields[1].At(1))
+
+	// Tables which already have a cluster column are kept as they are.
+	addClusterLabel(table, "production")
+	assert.Equal(t, 2, len(table.Fields))
+}
+
+func TestQueryFanOutConcurrency(t *testing.T) {
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	cloud := &fakeCloudClient{newVizier: func(ctx context.Context, clusterID string) (vizierClient, error) {
+		return &fakeVizierClient{run: func(ctx context.Context, pxlScript string, mux pxapi.TableMuxer) error {
+			mu.Lock()
+			running++
+			if running > maxRunning {
+				maxRunning = running
+			}
+			mu.Unlock()
+			time.Sleep(10 * time.Millisecond)
+			mu.Lock()
+			running--
+			mu.Unlock()
+			return echoScript(ctx, pxlScript, mux)
+		}}, nil
+	}}
+	ds := newFakeDatasource(cloud)
+	req := makeQueryDataRequest(backend.DataQuery{
+		RefID: "A",
+		JSON:  []byte(`{"queryType": "run-script", "queryBody": {"clusterIDs": ["a", "b", "c", "$pixieCluster"], "pxlScript": "import px"}}`),
+	})
+	req.PluginContext.DataSourceInstanceSettings.JSONData = []byte(`{"cloudAddr": "", "maxConcurrentQueries": 2}`)
+
+	resp, err := ds.QueryData(context.Background(), req)
+	assert.Nil(t, err)
+	assert.Nil(t, resp.Responses["A"].Error)
+	assert.Equal(t, map[string]int{"a": 1, "b": 1, "c": 1}, cloud.vizierClients)
+	assert.LessOrEqual(t, maxRunning, 2)
+}
+
+func TestQueryFanOutUnresolvedVariables(t *testing.T) {
+	cloud := &fakeCloudClient{newVizier: func(ctx context.Context, clusterID string) (vizierClient, error) {
+		return &fakeVizierClient{run: echoScript}, nil
+	}}
+	ds := newFakeDatasource(cloud)
+	query := func(clusterID string) backend.DataQuery {
+		return backend.DataQuery{
+			RefID: "A",
+			JSON: []byte(`{"queryType": "run-script", "clusterID": "` + clusterID + `",
+				"queryBody": {"clusterIDs": ["$pixieCluster"], "pxlScript": "import px"}}`),
+		}
+	}
+
+	// The query's saved cluster is used when every selected cluster is a variable.
+	resp, err := ds.QueryData(context.Background(), makeQueryDataRequest(query("saved")))
+	assert.Nil(t, err)
+	assert.Nil(t, resp.Responses["A"].Error)
+	assert.Equal(t, map[string]int{"saved": 1}, cloud.vizierClients)
+
+	// Then the datasource's default cluster.
+	req := makeQueryDataRequest(query(""))
+	req.PluginContext.DataSourceInstanceSettings.DecryptedSecureJSONData[clusterIDField] = "default"
+	resp, err = newFakeDatasource(cloud).QueryData(context.Background(), req)
+	assert.Nil(t, err)
+	assert.Nil(t, resp.Responses["A"].Error)
+	assert.Equal(t, map[string]int{"saved": 1, "default": 1}, cloud.vizierClients)
+
+	resp, err = newFakeDatasource(cloud).QueryData(context.Background(), makeQueryDataRequest(query("")))
+	assert.Nil(t, err)
+	assert.NotNil(t, resp.Responses["A"].Error)
+}
@@ -0,0 +1,177 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"context"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+)
+
+// detachedContext keeps the values of a context, such as its trace, without
+// its deadline and cancellation.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (c detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (c detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (c detachedContext) Err() error {
+	return nil
+}
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
+
+// copyResponse returns a copy of response whose frames can be modified.
+func copyResponse(response *backend.DataResponse) (*backend.DataResponse, error) {
+	encoded, err := response.Frames.MarshalArrow()
+	if err != nil {
+		return nil, err
+	}
+	frames, err := data.UnmarshalArrowFrames(encoded)
+	if err != nil {
+		return nil, err
+	}
+	return &backend.DataResponse{Frames: frames, Error: response.Error}, nil
+}
+
+// flight is an execution of a script shared by identical queries.
+type flight struct {
+	done     chan struct{}
+	response *backend.DataResponse
+	err      error
+	cancel   context.CancelFunc
+	// waiters is the number of queries waiting for the execution, and joined
+	// the number of queries which ever did.
+	waiters int
+	joined  int
+}
+
+// flightGroup shares the executions of identical scripts running concurrently.
+type flightGroup struct {
+	// mu guards flights and the waiters of each flight.
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// do runs execute once for the concurrent calls with key, and returns its
+// response and whether other calls share it. The execution doesn't stop when
+// the call which started it is canceled, only once every call waiting for it
+// is, so that the others still get its response.
+func (g *flightGroup) do(ctx context.Context, key string,
+	execute func(ctx context.Context) (*backend.DataResponse, error)) (*backend.DataResponse, bool, error) {
+
+	g.mu.Lock()
+	f, ok := g.flights[key]
+	if !ok {
+		if g.flights == nil {
+			g.flights = make(map[string]*flight)
+		}
+		execCtx, cancel := context.WithCancel(detachedContext{ctx})
+		f = &flight{done: make(chan struct{}), cancel: cancel}
+		g.flights[key] = f
+		go func() {
+			defer cancel()
+			f.response, f.err = execute(execCtx)
+			g.mu.Lock()
+			g.remove(key, f)
+			g.mu.Unlock()
+			close(f.done)
+		}()
+	}
+	f.waiters++
+	f.joined++
+	g.mu.Unlock()
+
+	select {
+	case <-ctx.Done():
+		g.mu.Lock()
+		defer g.mu.Unlock()
+		f.waiters--
+		if f.waiters == 0 {
+			// Later calls start a new execution rather than join the canceled one.
+			g.remove(key, f)
+			f.cancel()
+		}
+		return nil, false, canceledError(ctx)
+	case <-f.done:
+		// The flight was removed before done was closed, so joined is final.
+		return f.response, f.joined > 1, f.err
+	}
+}
+
+// remove removes f from the flights, unless a new flight replaced it.
+func (g *flightGroup) remove(key string, f *flight) {
+	if g.flights[key] == f {
+		delete(g.flights, key)
+	}
+}
+
+// flightKey returns the key of the executions of the rendered pxlScript on
+// clusterID which identical queries share. Queries with other timeouts don't
+// share an execution, since it would run with the timeout of the first.
+func (qp PixieQueryProcessor) flightKey(pxlScript string, clusterID string) (string, error) {
+	scriptKey, err := qp.scriptKey(pxlScript, clusterID)
+	if err != nil {
+		return "", err
+	}
+	return hashKey(scriptKey, strconv.FormatInt(int64(qp.timeout), 10)), nil
+}
+
+// executeShared runs the rendered pxlScript on the cluster like executeScript,
+// sharing a single execution among the identical queries running concurrently.
+// Each query gets its own copy of the shared frames.
+func (qp PixieQueryProcessor) executeShared(
+	ctx context.Context,
+	pxlScript string,
+	query backend.DataQuery,
+	clusterID string,
+) (*backend.DataResponse, error) {
+
+	key, err := qp.flightKey(pxlScript, clusterID)
+	if err != nil {
+		return nil, newQueryError(statusInternal, "unable to compute the script key: %v", err)
+	}
+	response, shared, err := qp.instance.flights.do(ctx, key, func(execCtx context.Context) (*backend.DataResponse, error) {
+		return qp.executeScript(execCtx, pxlScript, query, clusterID)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !shared {
+		return response, nil
+	}
+	copied, err := copyResponse(response)
+	if err != nil {
+		return nil, newQueryError(statusInternal, "unable to copy the shared frames: %v", err)
+	}
+	return copied, nil
+}
@@ -0,0 +1,179 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/assert"
+)
+
+type testContextKey struct{}
+
+func TestDetachedContext(t *testing.T) {
+	parent, cancel := context.WithTimeout(context.WithValue(context.Background(), testContextKey{}, "value"), time.Minute)
+	cancel()
+
+	// The detached context keeps the values of its canceled parent.
+	ctx, cancel := context.WithTimeout(detachedContext{parent}, time.Minute)
+	defer cancel()
+	assert.Nil(t, ctx.Err())
+	assert.Equal(t, "value", ctx.Value(testContextKey{}))
+}
+
+func TestCopyResponse(t *testing.T) {
+	response := &backend.DataResponse{
+		Frames: data.Frames{makeHTTPEventsFrame()},
+		Error:  newQueryError(statusScriptError, "failed"),
+	}
+	copied, err := copyResponse(response)
+	assert.Nil(t, err)
+	assert.Equal(t, response.Error, copied.Error)
+	assert.Equal(t, "checkout", copied.Frames[0].Fields[1].At(1))
+
+	addClusterLabel(copied.Frames[0], "cluster-a")
+	assert.Equal(t, 5, len(copied.Frames[0].Fields))
+	assert.Equal(t, 4, len(response.Frames[0].Fields))
+}
+
+func TestScriptKey(t *testing.T) {
+	qp := PixieQueryProcessor{}
+	key, err := qp.scriptKey("px.display(df)", "cluster-a")
+	assert.Nil(t, err)
+
+	same, _ := qp.scriptKey("px.display(df)", "cluster-a")
+	assert.Equal(t, key, same)
+	otherScript, _ := qp.scriptKey("px.display(df.head(10))", "cluster-a")
+	assert.NotEqual(t, key, otherScript)
+	otherCluster, _ := qp.scriptKey("px.display(df)", "cluster-b")
+	assert.NotEqual(t, key, otherCluster)
+	expanded, _ := PixieQueryProcessor{expandUPIDs: true}.scriptKey("px.display(df)", "cluster-a")
+	assert.NotEqual(t, key, expanded)
+	// Queries of other types convert the frames of the script differently.
+	traces, _ := PixieQueryProcessor{queryType: RunTraceScript}.scriptKey("px.display(df)", "cluster-a")
+	assert.NotEqual(t, key, traces)
+}
+
+func TestFlightKey(t *testing.T) {
+	qp := PixieQueryProcessor{timeout: 30 * time.Second}
+	key, err := qp.flightKey("px.display(df)", "cluster-a")
+	assert.Nil(t, err)
+
+	// Queries with other timeouts don't share an execution.
+	other, _ := PixieQueryProcessor{timeout: time.Minute}.flightKey("px.display(df)", "cluster-a")
+	assert.NotEqual(t, key, other)
+	scriptKey, _ := qp.scriptKey("px.display(df)", "cluster-a")
+	assert.NotEqual(t, key, scriptKey)
+}
+
+func TestFlightGroupShares(t *testing.T) {
+	g := &flightGroup{}
+	release := make(chan struct{})
+	executions := 0
+	execute := func(ctx context.Context) (*backend.DataResponse, error) {
+		executions++
+		<-release
+		return &backend.DataResponse{}, nil
+	}
+
+	results := make(chan bool)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, shared, err := g.do(context.Background(), "key", execute)
+			assert.Nil(t, err)
+			results <- shared
+		}()
+	}
+	// Wait until both calls joined the flight.
+	for joined := 0; joined < 2; {
+		time.Sleep(time.Millisecond)
+		g.mu.Lock()
+		if f, ok := g.flights["key"]; ok {
+			joined = f.joined
+		}
+		g.mu.Unlock()
+	}
+	close(release)
+	assert.True(t, <-results)
+	assert.True(t, <-results)
+	assert.Equal(t, 1, executions)
+}
+
+func TestFlightGroupCanceledByAllWaiters(t *testing.T) {
+	g := &flightGroup{}
+	started := make(chan struct{}, 2)
+	canceled := make(chan struct{}, 2)
+	execute := func(ctx context.Context) (*backend.DataResponse, error) {
+		started <- struct{}{}
+		<-ctx.Done()
+		canceled <- struct{}{}
+		return nil, ctx.Err()
+	}
+
+	first, cancelFirst := context.WithCancel(context.Background())
+	second, cancelSecond := context.WithCancel(context.Background())
+	errs := make(chan error)
+	go func() {
+		_, _, err := g.do(first, "key", execute)
+		errs <- err
+	}()
+	<-started
+	go func() {
+		_, _, err := g.do(second, "key", execute)
+		errs <- err
+	}()
+	for joined := 0; joined < 2; {
+		time.Sleep(time.Millisecond)
+		g.mu.Lock()
+		joined = g.flights["key"].joined
+		g.mu.Unlock()
+	}
+
+	// The execution goes on while a query still waits for it.
+	cancelFirst()
+	assert.NotNil(t, <-errs)
+	select {
+	case <-canceled:
+		t.Fatal("the shared execution was canceled while a query waited for it")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	cancelSecond()
+	assert.NotNil(t, <-errs)
+	select {
+	case <-canceled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the shared execution wasn't canceled once every query left")
+	}
+
+	// Later queries start a new execution.
+	third, cancelThird := context.WithCancel(context.Background())
+	go func() {
+		_, _, err := g.do(third, "key", execute)
+		errs <- err
+	}()
+	<-started
+	cancelThird()
+	assert.NotNil(t, <-errs)
+	<-canceled
+}
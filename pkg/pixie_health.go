@@ -0,0 +1,274 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"px.dev/pxapi"
+)
+
+// healthCheckScript is the PxL script whose round trip is measured by the
+// health check.
+const healthCheckScript = `
+import px
+px.display(px.DataFrame(table='process_stats', start_time='-10s').head(1))
+`
+
+// The stages of the health check, in order.
+const (
+	stageSettings = "settings"
+	stageCloud    = "cloud"
+	stageAPIKey   = "api_key"
+	stageClusters = "clusters"
+	stageCluster  = "cluster"
+	stageScript   = "script"
+)
+
+// The outcomes of the stages of the health check.
+const (
+	stageOK      = "ok"
+	stageError   = "error"
+	stageSkipped = "skipped"
+)
+
+// healthStage is the outcome of a stage of the health check, returned in the
+// JSON details of the result.
+type healthStage struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	// DurationMs is the time the stage took, in milliseconds.
+	DurationMs int64 `json:"durationMs"`
+}
+
+// healthCheck records the stages of a health check.
+type healthCheck struct {
+	stages []healthStage
+	start  time.Time
+}
+
+// begin starts timing a stage.
+func (h *healthCheck) begin() {
+	h.start = time.Now()
+}
+
+// pass records that the stage started by begin passed.
+func (h *healthCheck) pass(name string, format string, args ...interface{}) {
+	h.stages = append(h.stages, healthStage{
+		Name:       name,
+		Status:     stageOK,
+		Message:    fmt.Sprintf(format, args...),
+		DurationMs: time.Since(h.start).Milliseconds(),
+	})
+}
+
+// fail records that the stage started by begin failed with err.
+func (h *healthCheck) fail(name string, err error, format string, args ...interface{}) {
+	h.stages = append(h.stages, healthStage{
+		Name:       name,
+		Status:     stageError,
+		Message:    fmt.Sprintf("%s: %v", fmt.Sprintf(format, args...), err),
+		DurationMs: time.Since(h.start).Milliseconds(),
+	})
+}
+
+// skip records the stages which couldn't run.
+func (h *healthCheck) skip(reason string, names ...string) {
+	for _, name := range names {
+		h.stages = append(h.stages, healthStage{Name: name, Status: stageSkipped, Message: reason})
+	}
+}
+
+// failed returns the first stage which failed, or nil.
+func (h *healthCheck) failed() *healthStage {
+	for i := range h.stages {
+		if h.stages[i].Status == stageError {
+			return &h.stages[i]
+		}
+	}
+	return nil
+}
+
+// isAuthError returns whether err means Pixie Cloud rejected the API key.
+func isAuthError(err error) bool {
+	switch status.Code(err) {
+	case codes.Unauthenticated, codes.PermissionDenied:
+		return true
+	}
+	return false
+}
+
+// findCluster returns the vizier of clusterID, or an error if it can't be queried.
+func findCluster(clusterID string, viziers []*pxapi.VizierInfo) (*pxapi.VizierInfo, error) {
+	for _, vizier := range viziers {
+		if vizier.ID != clusterID {
+			continue
+		}
+		if vizier.Status == pxapi.VizierStatusDisconnected {
+			return vizier, fmt.Errorf("cluster %q is disconnected", vizier.Name)
+		}
+		return vizier, nil
+	}
+	return nil, fmt.Errorf("cluster %q isn't visible with this API key", clusterID)
+}
+
+// runHealthCheck checks each stage of the connection to Pixie, skipping the
+// stages which depend on a failed one. Pixie Cloud is reached with connect.
+func runHealthCheck(ctx context.Context, instanceSettings backend.DataSourceInstanceSettings,
+	connect func(ctx context.Context, settings *pixieSettings) (cloudClient, error)) *healthCheck {
+	h := &healthCheck{}
+
+	h.begin()
+	settings, err := loadSettings(instanceSettings)
+	if err == nil {
+		err = settings.validate()
+	}
+	if err != nil {
+		h.fail(stageSettings, err, "Invalid datasource settings")
+		h.skip("invalid settings", stageCloud, stageAPIKey, stageClusters, stageCluster, stageScript)
+		return h
+	}
+	h.pass(stageSettings, "The datasource settings are valid")
+
+	h.begin()
+	client, err := connect(ctx, settings)
+	if err != nil {
+		h.fail(stageCloud, err, "Error connecting Pixie client")
+		h.skip("Pixie Cloud is unreachable", stageAPIKey, stageClusters, stageCluster, stageScript)
+		return h
+	}
+
+	// Listing the clusters checks that Pixie Cloud is reachable and accepts the API key.
+	h.begin()
+	viziers, err := client.ListViziers(ctx)
+	switch {
+	case err == nil:
+		h.pass(stageCloud, "Pixie Cloud is reachable")
+		h.pass(stageAPIKey, "The API key is valid")
+	case isAuthError(err):
+		h.pass(stageCloud, "Pixie Cloud is reachable")
+		h.fail(stageAPIKey, err, "The API key was rejected")
+	default:
+		h.fail(stageCloud, err, "Unable to reach Pixie Cloud")
+		h.skip("Pixie Cloud is unreachable", stageAPIKey)
+	}
+	if err != nil {
+		h.skip("unable to list the clusters", stageClusters, stageCluster, stageScript)
+		return h
+	}
+
+	connected := 0
+	for _, vizier := range viziers {
+		if vizier.Status != pxapi.VizierStatusDisconnected {
+			connected++
+		}
+	}
+	if connected == 0 {
+		h.fail(stageClusters, fmt.Errorf("%d clusters visible, none connected", len(viziers)),
+			"No cluster can be queried with this API key")
+		h.skip("no connected cluster", stageCluster, stageScript)
+		return h
+	}
+	h.pass(stageClusters, "%d clusters visible, %d connected", len(viziers), connected)
+
+	// only check the health of clusterID if the user specified clusterID
+	if settings.ClusterID == "" {
+		h.skip("no default cluster configured", stageCluster, stageScript)
+		return h
+	}
+	h.begin()
+	vizier, err := findCluster(settings.ClusterID, viziers)
+	var vz vizierClient
+	if err == nil {
+		vz, err = client.NewVizierClient(ctx, settings.ClusterID)
+	}
+	if err != nil {
+		h.fail(stageCluster, err, "Unable to connect to cluster %q", settings.ClusterID)
+		h.skip("unable to connect to the cluster", stageScript)
+		return h
+	}
+	h.pass(stageCluster, "Cluster %q is %s", vizier.Name, vizier.Status)
+
+	h.begin()
+	ctx, cancel := context.WithTimeout(ctx, time.Duration(settings.QueryTimeout)*time.Second)
+	defer cancel()
+	tm := &PixieToGrafanaTableMux{limits: settings.resultLimits()}
+	resultSet, err := vz.ExecuteScript(ctx, healthCheckScript, tm)
+	if resultSet != nil && (err == nil || err == io.EOF) {
+		defer resultSet.Close()
+		err = resultSet.Stream()
+	}
+	if err != nil {
+		h.fail(stageScript, err, "Unable to run a PxL script")
+		return h
+	}
+	h.pass(stageScript, "PxL script round trip took %d ms", time.Since(h.start).Milliseconds())
+	return h
+}
+
+// CheckHealth implements the Grafana service health check API.
+func (td *PixieDatasource) CheckHealth(ctx context.Context, req *backend.CheckHealthRequest) (*backend.CheckHealthResult, error) {
+	// The instance is only needed once the settings are valid, since it can't
+	// be created otherwise.
+	connect := func(ctx context.Context, settings *pixieSettings) (cloudClient, error) {
+		instance, err := td.getInstance(req.PluginContext)
+		if err != nil {
+			return nil, err
+		}
+		return instance.connect(ctx, settings)
+	}
+	h := runHealthCheck(ctx, *req.PluginContext.DataSourceInstanceSettings, connect)
+	details, err := json.Marshal(map[string]interface{}{"stages": h.stages})
+	if err != nil {
+		return nil, err
+	}
+
+	if stage := h.failed(); stage != nil {
+		message := fmt.Sprintf("Health check failed at the %s stage. %s", stage.Name, stage.Message)
+		log.DefaultLogger.Warn(message)
+		return &backend.CheckHealthResult{
+			Status:      backend.HealthStatusError,
+			Message:     message,
+			JSONDetails: details,
+		}, nil
+	}
+
+	message := "Connection to Pixie cluster successfully configured"
+	for _, stage := range h.stages {
+		if stage.Name == stageScript && stage.Status == stageOK {
+			message = fmt.Sprintf("%s. %s", message, stage.Message)
+		}
+	}
+	log.DefaultLogger.Info(message)
+	return &backend.CheckHealthResult{
+		Status:      backend.HealthStatusOk,
+		Message:     message,
+		JSONDetails: details,
+	}, nil
+}
@@ -0,0 +1,203 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"px.dev/pxapi"
+)
+
+func TestCheckHealthInvalidSettings(t *testing.T) {
+	result, err := (&PixieDatasource{}).CheckHealth(context.Background(), &backend.CheckHealthRequest{
+		PluginContext: backend.PluginContext{
+			DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{
+				JSONData: []byte(`{"queryTimeout": -1}`),
+			},
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, backend.HealthStatusError, result.Status)
+	assert.Contains(t, result.Message, "settings stage")
+
+	// Every stage is reported, the ones after the failed stage are skipped.
+	var details struct {
+		Stages []healthStage `json:"stages"`
+	}
+	assert.Nil(t, json.Unmarshal(result.JSONDetails, &details))
+	assert.Equal(t, 6, len(details.Stages))
+	assert.Equal(t, stageError, details.Stages[0].Status)
+	for _, stage := range details.Stages[1:] {
+		assert.Equal(t, stageSkipped, stage.Status, stage.Name)
+	}
+}
+
+func TestIsAuthError(t *testing.T) {
+	assert.True(t, isAuthError(status.Error(codes.Unauthenticated, "invalid API key")))
+	assert.True(t, isAuthError(status.Error(codes.PermissionDenied, "denied")))
+	assert.False(t, isAuthError(status.Error(codes.Unavailable, "connection refused")))
+	assert.False(t, isAuthError(errors.New("timeout")))
+}
+
+func TestFindCluster(t *testing.T) {
+	viziers := []*pxapi.VizierInfo{
+		{ID: "1", Name: "staging", Status: pxapi.VizierStatusHealthy},
+		{ID: "2", Name: "production", Status: pxapi.VizierStatusDisconnected},
+	}
+	vizier, err := findCluster("1", viziers)
+	assert.Nil(t, err)
+	assert.Equal(t, "staging", vizier.Name)
+
+	_, err = findCluster("2", viziers)
+	assert.NotNil(t, err)
+	_, err = findCluster("3", viziers)
+	assert.NotNil(t, err)
+}
+
+// checkHealthStages runs the health check of a datasource connecting to cloud,
+// with clusterID as its default cluster, and returns the status of each stage.
+func checkHealthStages(t *testing.T, cloud *fakeCloudClient, clusterID string) map[string]string {
+	result, err := newFakeDatasource(cloud).CheckHealth(context.Background(), &backend.CheckHealthRequest{
+		PluginContext: backend.PluginContext{
+			DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{
+				ID:                      1,
+				JSONData:                []byte(`{"cloudAddr": ""}`),
+				DecryptedSecureJSONData: map[string]string{apiKeyField: "key", clusterIDField: clusterID},
+			},
+		},
+	})
+	assert.Nil(t, err)
+
+	var details struct {
+		Stages []healthStage `json:"stages"`
+	}
+	assert.Nil(t, json.Unmarshal(result.JSONDetails, &details))
+	stages := make(map[string]string)
+	for _, stage := range details.Stages {
+		stages[stage.Name] = stage.Status
+	}
+	failed := false
+	for _, status := range stages {
+		failed = failed || status == stageError
+	}
+	if failed {
+		assert.Equal(t, backend.HealthStatusError, result.Status)
+	} else {
+		assert.Equal(t, backend.HealthStatusOk, result.Status)
+	}
+	return stages
+}
+
+func TestCheckHealthStages(t *testing.T) {
+	viziers := []*pxapi.VizierInfo{
+		{ID: "1", Name: "staging", Status: pxapi.VizierStatusHealthy},
+		{ID: "2", Name: "production", Status: pxapi.VizierStatusDisconnected},
+	}
+	runScript := func(err error) func(ctx context.Context, clusterID string) (vizierClient, error) {
+		return func(ctx context.Context, clusterID string) (vizierClient, error) {
+			return &fakeVizierClient{run: func(ctx context.Context, pxlScript string, mux pxapi.TableMuxer) error {
+				if err != nil {
+					return err
+				}
+				return echoScript(ctx, pxlScript, mux)
+			}}, nil
+		}
+	}
+
+	tests := []struct {
+		name      string
+		cloud     *fakeCloudClient
+		clusterID string
+		// stages is the status of the cloud, api_key, clusters, cluster and script stages.
+		stages []string
+	}{
+		{
+			name:      "healthy",
+			cloud:     &fakeCloudClient{viziers: viziers, newVizier: runScript(nil)},
+			clusterID: "1",
+			stages:    []string{stageOK, stageOK, stageOK, stageOK, stageOK},
+		},
+		{
+			name:      "cloud unreachable",
+			cloud:     &fakeCloudClient{connectErr: errors.New("dial failed")},
+			clusterID: "1",
+			stages:    []string{stageError, stageSkipped, stageSkipped, stageSkipped, stageSkipped},
+		},
+		{
+			name:      "listing fails",
+			cloud:     &fakeCloudClient{listErr: status.Error(codes.Unavailable, "connection refused")},
+			clusterID: "1",
+			stages:    []string{stageError, stageSkipped, stageSkipped, stageSkipped, stageSkipped},
+		},
+		{
+			name:      "API key rejected",
+			cloud:     &fakeCloudClient{listErr: status.Error(codes.Unauthenticated, "invalid API key")},
+			clusterID: "1",
+			stages:    []string{stageOK, stageError, stageSkipped, stageSkipped, stageSkipped},
+		},
+		{
+			name:      "no connected cluster",
+			cloud:     &fakeCloudClient{viziers: viziers[1:]},
+			clusterID: "1",
+			stages:    []string{stageOK, stageOK, stageError, stageSkipped, stageSkipped},
+		},
+		{
+			name:   "no default cluster",
+			cloud:  &fakeCloudClient{viziers: viziers},
+			stages: []string{stageOK, stageOK, stageOK, stageSkipped, stageSkipped},
+		},
+		{
+			name:      "disconnected cluster",
+			cloud:     &fakeCloudClient{viziers: viziers, newVizier: runScript(nil)},
+			clusterID: "2",
+			stages:    []string{stageOK, stageOK, stageOK, stageError, stageSkipped},
+		},
+		{
+			name: "cluster client fails",
+			cloud: &fakeCloudClient{viziers: viziers, newVizier: func(ctx context.Context, clusterID string) (vizierClient, error) {
+				return nil, status.Error(codes.Unavailable, "cluster unreachable")
+			}},
+			clusterID: "1",
+			stages:    []string{stageOK, stageOK, stageOK, stageError, stageSkipped},
+		},
+		{
+			name:      "script fails",
+			cloud:     &fakeCloudClient{viziers: viziers, newVizier: runScript(errors.New("table process_stats not found"))},
+			clusterID: "1",
+			stages:    []string{stageOK, stageOK, stageOK, stageOK, stageError},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stages := checkHealthStages(t, test.cloud, test.clusterID)
+			assert.Equal(t, stageOK, stages[stageSettings])
+			for i, name := range []string{stageCloud, stageAPIKey, stageClusters, stageCluster, stageScript} {
+				assert.Equal(t, test.stages[i], stages[name], name)
+			}
+		})
+	}
+}
@@ -0,0 +1,258 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/instancemgmt"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"px.dev/pxapi"
+)
+
+// cloudClient is the Pixie Cloud API used by the plugin.
+type cloudClient interface {
+	ListViziers(ctx context.Context) ([]*pxapi.VizierInfo, error)
+	NewVizierClient(ctx context.Context, clusterID string) (vizierClient, error)
+}
+
+// vizierClient runs PxL scripts on a cluster.
+type vizierClient interface {
+	ExecuteScript(ctx context.Context, pxlScript string, mux pxapi.TableMuxer) (scriptResults, error)
+}
+
+// scriptResults streams the results of a PxL script to its table muxer.
+type scriptResults interface {
+	Stream() error
+	Close() error
+}
+
+// pxapiCloudClient is the cloudClient of a pxapi.Client.
+type pxapiCloudClient struct {
+	*pxapi.Client
+}
+
+func (c pxapiCloudClient) NewVizierClient(ctx context.Context, clusterID string) (vizierClient, error) {
+	vz, err := c.Client.NewVizierClient(ctx, clusterID)
+	if err != nil {
+		return nil, err
+	}
+	return pxapiVizierClient{vz}, nil
+}
+
+// pxapiVizierClient is the vizierClient of a pxapi.VizierClient.
+type pxapiVizierClient struct {
+	*pxapi.VizierClient
+}
+
+func (c pxapiVizierClient) ExecuteScript(ctx context.Context, pxlScript string, mux pxapi.TableMuxer) (scriptResults, error) {
+	results, err := c.VizierClient.ExecuteScript(ctx, pxlScript, mux)
+	if results == nil {
+		return nil, err
+	}
+	return results, err
+}
+
+// connectCloud creates the Pixie Cloud client of settings.
+func connectCloud(ctx context.Context, settings *pixieSettings) (cloudClient, error) {
+	client, err := createClient(ctx, settings.APIKey, settings.CloudAddr)
+	if err != nil {
+		return nil, err
+	}
+	return pxapiCloudClient{client}, nil
+}
+
+// isConnectionError returns whether err means a client can no longer reach
+// its cluster, so that it should be created again.
+func isConnectionError(err error) bool {
+	return status.Code(err) == codes.Unavailable || isAuthError(err)
+}
+
+// pixieInstance holds the Pixie clients for a single datasource configuration.
+// It is created by the instance manager and replaced whenever the datasource
+// settings change.
+type pixieInstance struct {
+	settings *pixieSettings
+	// uid is the Grafana assigned identifier of the datasource.
+	uid string
+	// connect creates the Pixie Cloud client of the instance.
+	connect func(ctx context.Context, settings *pixieSettings) (cloudClient, error)
+
+	// mu guards client, vizierClients and generation. It isn't held while
+	// clients are created, so a slow cluster doesn't stall the queries of others.
+	mu     sync.Mutex
+	client cloudClient
+	// vizierClients caches a Vizier client per cluster ID.
+	vizierClients map[string]vizierClient
+	// generation is incremented by Dispose, so that clients created before
+	// aren't cached.
+	generation int
+	// connecting shares the creation of a client among concurrent queries.
+	connecting singleflight.Group
+
+	// cache holds the responses of scripts, or is nil if caching is disabled.
+	cache *queryCache
+	// flights shares the executions of identical scripts running concurrently.
+	flights flightGroup
+}
+
+// newPixieInstance creates a pixieInstance from the datasource settings.
+// Clients are created lazily on first use.
+func newPixieInstance(instanceSettings backend.DataSourceInstanceSettings) (instancemgmt.Instance, error) {
+	settings, err := loadSettings(instanceSettings)
+	if err != nil {
+		return nil, fmt.Errorf("invalid datasource settings: %v", err)
+	}
+	if err := settings.validate(); err != nil {
+		return nil, fmt.Errorf("invalid datasource settings: %v", err)
+	}
+
+	instance := &pixieInstance{
+		settings:      settings,
+		uid:           instanceSettings.UID,
+		connect:       connectCloud,
+		vizierClients: make(map[string]vizierClient),
+	}
+	if settings.CacheTTL > 0 {
+		instance.cache = newQueryCache(time.Duration(settings.CacheTTL)*time.Second, settings.CacheMaxBytes)
+	}
+	return instance, nil
+}
+
+// createShared creates a client with create, once for the concurrent queries
+// asking for the client of key. The client is created without the cancellation
+// of the query which started it, within the query timeout of the datasource.
+func (i *pixieInstance) createShared(ctx context.Context, key string,
+	create func(ctx context.Context) (interface{}, error)) (interface{}, error) {
+
+	results := i.connecting.DoChan(key, func() (interface{}, error) {
+		ctx, cancel := context.WithTimeout(detachedContext{ctx}, time.Duration(i.settings.QueryTimeout)*time.Second)
+		defer cancel()
+		return create(ctx)
+	})
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case result := <-results:
+		return result.Val, result.Err
+	}
+}
+
+// getClient returns the Pixie API client for this instance, creating it if needed.
+func (i *pixieInstance) getClient(ctx context.Context) (cloudClient, error) {
+	i.mu.Lock()
+	client, generation := i.client, i.generation
+	i.mu.Unlock()
+	if client != nil {
+		return client, nil
+	}
+
+	value, err := i.createShared(ctx, clientCloud, func(ctx context.Context) (interface{}, error) {
+		start := time.Now()
+		client, err := i.connect(ctx, i.settings)
+		clientCreationDuration.WithLabelValues(clientCloud).Observe(time.Since(start).Seconds())
+		if err != nil {
+			return nil, err
+		}
+		i.mu.Lock()
+		defer i.mu.Unlock()
+		if i.generation == generation {
+			i.client = client
+		}
+		return client, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(cloudClient), nil
+}
+
+// getVizierClient returns the Vizier client for clusterID, creating it if needed.
+func (i *pixieInstance) getVizierClient(ctx context.Context, clusterID string) (vizierClient, error) {
+	// untrimmed clusterID string will cause an error when creating a vizier client
+	clusterID = strings.TrimSpace(clusterID)
+
+	i.mu.Lock()
+	vz, generation := i.vizierClients[clusterID], i.generation
+	i.mu.Unlock()
+	if vz != nil {
+		return vz, nil
+	}
+
+	client, err := i.getClient(ctx)
+	if err != nil {
+		return nil, err
+	}
+	value, err := i.createShared(ctx, clientVizier+"/"+clusterID, func(ctx context.Context) (interface{}, error) {
+		start := time.Now()
+		ctx, span := tracer.Start(ctx, "NewVizierClient", trace.WithAttributes(attribute.String("cluster_id", clusterID)))
+		vz, err := client.NewVizierClient(ctx, clusterID)
+		endSpan(span, err)
+		clientCreationDuration.WithLabelValues(clientVizier).Observe(time.Since(start).Seconds())
+		if err != nil {
+			return nil, err
+		}
+		i.mu.Lock()
+		defer i.mu.Unlock()
+		if i.generation == generation {
+			i.vizierClients[clusterID] = vz
+		}
+		return vz, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return value.(vizierClient), nil
+}
+
+// evictVizierClient drops vz, the client of clusterID, after it failed to
+// reach its cluster, so that the next query creates a new one.
+func (i *pixieInstance) evictVizierClient(clusterID string, vz vizierClient) {
+	clusterID = strings.TrimSpace(clusterID)
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.vizierClients[clusterID] == vz {
+		delete(i.vizierClients, clusterID)
+	}
+}
+
+// Dispose drops the cached clients and responses. It is called by the instance manager
+// before the instance is replaced with one using updated settings.
+func (i *pixieInstance) Dispose() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.client = nil
+	i.vizierClients = make(map[string]vizierClient)
+	i.generation++
+	if i.cache != nil {
+		i.cache.clear()
+	}
+}
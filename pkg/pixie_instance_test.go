@@ -0,0 +1,245 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/datasource"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/instancemgmt"
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"px.dev/pxapi"
+	"px.dev/pxapi/proto/vizierpb"
+	"px.dev/pxapi/types"
+)
+
+// fakeScriptResults streams the tables of a fakeVizierClient.
+type fakeScriptResults struct {
+	stream func() error
+}
+
+func (r *fakeScriptResults) Stream() error {
+	return r.stream()
+}
+
+func (r *fakeScriptResults) Close() error {
+	return nil
+}
+
+// fakeVizierClient runs scripts with run, which sends their tables to mux.
+type fakeVizierClient struct {
+	run func(ctx context.Context, pxlScript string, mux pxapi.TableMuxer) error
+}
+
+func (c *fakeVizierClient) ExecuteScript(ctx context.Context, pxlScript string, mux pxapi.TableMuxer) (scriptResults, error) {
+	return &fakeScriptResults{stream: func() error { return c.run(ctx, pxlScript, mux) }}, nil
+}
+
+// fakeCloudClient creates Vizier clients with newVizier and counts the clients created.
+// Connecting fails with connectErr and listing the clusters with listErr, if set.
+type fakeCloudClient struct {
+	viziers    []*pxapi.VizierInfo
+	newVizier  func(ctx context.Context, clusterID string) (vizierClient, error)
+	connectErr error
+	listErr    error
+
+	mu            sync.Mutex
+	connects      int
+	vizierClients map[string]int
+}
+
+func (c *fakeCloudClient) ListViziers(ctx context.Context) ([]*pxapi.VizierInfo, error) {
+	if c.listErr != nil {
+		return nil, c.listErr
+	}
+	return c.viziers, nil
+}
+
+func (c *fakeCloudClient) NewVizierClient(ctx context.Context, clusterID string) (vizierClient, error) {
+	c.mu.Lock()
+	if c.vizierClients == nil {
+		c.vizierClients = make(map[string]int)
+	}
+	c.vizierClients[clusterID]++
+	c.mu.Unlock()
+	return c.newVizier(ctx, clusterID)
+}
+
+// newFakeDatasource creates a datasource whose instances connect to cloud.
+func newFakeDatasource(cloud *fakeCloudClient) *PixieDatasource {
+	return &PixieDatasource{
+		im: datasource.NewInstanceManager(func(settings backend.DataSourceInstanceSettings) (instancemgmt.Instance, error) {
+			instance, err := newPixieInstance(settings)
+			if err != nil {
+				return nil, err
+			}
+			instance.(*pixieInstance).connect = func(ctx context.Context, settings *pixieSettings) (cloudClient, error) {
+				cloud.mu.Lock()
+				defer cloud.mu.Unlock()
+				cloud.connects++
+				if cloud.connectErr != nil {
+					return nil, cloud.connectErr
+				}
+				return cloud, nil
+			}
+			return instance, nil
+		}),
+	}
+}
+
+// sendTable sends a table of records to mux, as Pixie does while streaming results.
+func sendTable(ctx context.Context, mux pxapi.TableMuxer, metadata *types.TableMetadata, records []*types.Record) error {
+	handler, err := mux.AcceptTable(ctx, *metadata)
+	if err != nil {
+		return err
+	}
+	if err := handler.HandleInit(ctx, *metadata); err != nil {
+		return err
+	}
+	for _, record := range records {
+		if err := handler.HandleRecord(ctx, record); err != nil {
+			return err
+		}
+	}
+	return handler.HandleDone(ctx)
+}
+
+// echoScript sends a table whose single row holds the script.
+func echoScript(ctx context.Context, pxlScript string, mux pxapi.TableMuxer) error {
+	metadata := makeTableMetadata(vizierpb.STRING)
+	value := types.NewStringValue(&metadata.ColInfo[0])
+	value.ScanString(pxlScript)
+	return sendTable(ctx, mux, metadata, []*types.Record{{Data: []types.Datum{value}, TableMetadata: metadata}})
+}
+
+func makeScriptQuery(refID string, clusterID string, pxlScript string) backend.DataQuery {
+	return backend.DataQuery{
+		RefID: refID,
+		JSON:  []byte(fmt.Sprintf(`{"queryType": "run-script", "clusterID": %q, "queryBody": {"pxlScript": %q}}`, clusterID, pxlScript)),
+	}
+}
+
+func TestQueryDataReusesClients(t *testing.T) {
+	cloud := &fakeCloudClient{newVizier: func(ctx context.Context, clusterID string) (vizierClient, error) {
+		return &fakeVizierClient{run: echoScript}, nil
+	}}
+	ds := newFakeDatasource(cloud)
+
+	for i := 0; i < 2; i++ {
+		req := makeQueryDataRequest(
+			makeScriptQuery("A", "cluster-a", "script a"),
+			makeScriptQuery("B", "cluster-a", "script b"),
+			makeScriptQuery("C", "cluster-b", "script c"),
+		)
+		resp, err := ds.QueryData(context.Background(), req)
+		assert.Nil(t, err)
+
+		// The concurrent results are returned under the RefID of their query.
+		for refID, script := range map[string]string{"A": "script a", "B": "script b", "C": "script c"} {
+			assert.Nil(t, resp.Responses[refID].Error)
+			assert.Equal(t, script, resp.Responses[refID].Frames[0].Fields[0].At(0))
+		}
+	}
+	assert.Equal(t, 1, cloud.connects)
+	assert.Equal(t, map[string]int{"cluster-a": 1, "cluster-b": 1}, cloud.vizierClients)
+}
+
+func TestDisposeResetsClients(t *testing.T) {
+	cloud := &fakeCloudClient{newVizier: func(ctx context.Context, clusterID string) (vizierClient, error) {
+		return &fakeVizierClient{run: echoScript}, nil
+	}}
+	ds := newFakeDatasource(cloud)
+	instance, err := ds.getInstance(makeQueryDataRequest().PluginContext)
+	assert.Nil(t, err)
+
+	_, err = instance.getVizierClient(context.Background(), "cluster-a")
+	assert.Nil(t, err)
+	_, err = instance.getVizierClient(context.Background(), "cluster-a")
+	assert.Nil(t, err)
+	instance.Dispose()
+	_, err = instance.getVizierClient(context.Background(), "cluster-a")
+	assert.Nil(t, err)
+
+	assert.Equal(t, 2, cloud.connects)
+	assert.Equal(t, 2, cloud.vizierClients["cluster-a"])
+}
+
+func TestSlowClusterDoesNotBlockOthers(t *testing.T) {
+	unblock := make(chan struct{})
+	cloud := &fakeCloudClient{newVizier: func(ctx context.Context, clusterID string) (vizierClient, error) {
+		if clusterID == "slow" {
+			<-unblock
+		}
+		return &fakeVizierClient{run: echoScript}, nil
+	}}
+	ds := newFakeDatasource(cloud)
+	instance, err := ds.getInstance(makeQueryDataRequest().PluginContext)
+	assert.Nil(t, err)
+
+	slow := make(chan error)
+	go func() {
+		_, err := instance.getVizierClient(context.Background(), "slow")
+		slow <- err
+	}()
+	fast := make(chan error)
+	go func() {
+		_, err := instance.getVizierClient(context.Background(), "fast")
+		fast <- err
+	}()
+
+	select {
+	case err := <-fast:
+		assert.Nil(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("creating the client of a cluster waited for another cluster")
+	}
+	close(unblock)
+	assert.Nil(t, <-slow)
+}
+
+func TestFailedVizierClientEvicted(t *testing.T) {
+	cloud := &fakeCloudClient{}
+	cloud.newVizier = func(ctx context.Context, clusterID string) (vizierClient, error) {
+		if cloud.vizierClients[clusterID] == 1 {
+			return &fakeVizierClient{run: func(context.Context, string, pxapi.TableMuxer) error {
+				return status.Error(codes.Unavailable, "cluster unreachable")
+			}}, nil
+		}
+		return &fakeVizierClient{run: echoScript}, nil
+	}
+	ds := newFakeDatasource(cloud)
+
+	resp, err := ds.QueryData(context.Background(), makeQueryDataRequest(makeScriptQuery("A", "cluster-a", "script a")))
+	assert.Nil(t, err)
+	assert.NotNil(t, resp.Responses["A"].Error)
+
+	// The failed client is replaced by the next query.
+	resp, err = ds.QueryData(context.Background(), makeQueryDataRequest(makeScriptQuery("A", "cluster-a", "script a")))
+	assert.Nil(t, err)
+	assert.Nil(t, resp.Responses["A"].Error)
+	assert.Equal(t, 2, cloud.vizierClients["cluster-a"])
+}
@@ -0,0 +1,198 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+// GrafanaMacro is a type which defines a macro.
+//
+// The supported macros are:
+//   - $__from, $__to: the start and end of the query's time range, in Unix nanoseconds.
+//   - $__interval: the suggested duration between time points, in nanoseconds.
+//   - $__interval_ms: the suggested duration between time points, in milliseconds.
+//   - $__range: the length of the query's time range, in nanoseconds.
+//   - $__timeFilter(df): a condition keeping the rows of df within the time range,
+//     e.g. `df = df[$__timeFilter(df)]`.
+//
+// __time_from, __time_to and __interval are accepted as aliases of $__from,
+// $__to and $__interval for scripts written for older versions of the plugin.
+// Macros are only expanded where they form a whole token of the script, never
+// inside identifiers, attributes, strings or comments.
+type GrafanaMacro string
+
+const (
+	fromMacro       GrafanaMacro = "$__from"
+	toMacro         GrafanaMacro = "$__to"
+	intervalMacro   GrafanaMacro = "$__interval"
+	intervalMsMacro GrafanaMacro = "$__interval_ms"
+	rangeMacro      GrafanaMacro = "$__range"
+	timeFilterMacro GrafanaMacro = "$__timeFilter"
+
+	// timeFromMacro is the legacy alias of $__from.
+	timeFromMacro GrafanaMacro = "__time_from"
+	// timeToMacro is the legacy alias of $__to.
+	timeToMacro GrafanaMacro = "__time_to"
+	// legacyIntervalMacro is the legacy alias of $__interval.
+	legacyIntervalMacro GrafanaMacro = "__interval"
+)
+
+// macroValues returns the replacement of every macro without arguments.
+func macroValues(query backend.DataQuery) map[GrafanaMacro]string {
+	from := fmt.Sprintf("%d", query.TimeRange.From.UnixNano())
+	to := fmt.Sprintf("%d", query.TimeRange.To.UnixNano())
+	interval := fmt.Sprintf("%d", query.Interval.Nanoseconds())
+	return map[GrafanaMacro]string{
+		fromMacro:           from,
+		toMacro:             to,
+		intervalMacro:       interval,
+		intervalMsMacro:     fmt.Sprintf("%d", query.Interval.Milliseconds()),
+		rangeMacro:          fmt.Sprintf("%d", query.TimeRange.Duration().Nanoseconds()),
+		timeFromMacro:       from,
+		timeToMacro:         to,
+		legacyIntervalMacro: interval,
+	}
+}
+
+func isIdentStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isIdentChar(c byte) bool {
+	return isIdentStart(c) || (c >= '0' && c <= '9')
+}
+
+// scanIdent returns the end of the identifier starting at start.
+func scanIdent(script string, start int) int {
+	end := start
+	for end < len(script) && isIdentChar(script[end]) {
+		end++
+	}
+	return end
+}
+
+// scanString returns the end of the string literal starting at start, which
+// is a quote. Triple-quoted strings may span several lines.
+func scanString(script string, start int) int {
+	quote := script[start : start+1]
+	if strings.HasPrefix(script[start:], strings.Repeat(quote, 3)) {
+		quote = strings.Repeat(quote, 3)
+	}
+	for i := start + len(quote); i < len(script); i++ {
+		switch {
+		case script[i] == '\\':
+			i++
+		case strings.HasPrefix(script[i:], quote):
+			return i + len(quote)
+		case script[i] == '\n' && len(quote) == 1:
+			return i
+		}
+	}
+	return len(script)
+}
+
+// scanTimeFilter parses the `(df)` arguments of $__timeFilter at start and
+// returns the dataframe name and the end of the macro call.
+func scanTimeFilter(script string, start int) (string, int, error) {
+	i := start
+	skipSpaces := func() {
+		for i < len(script) && (script[i] == ' ' || script[i] == '\t') {
+			i++
+		}
+	}
+	skipSpaces()
+	if i >= len(script) || script[i] != '(' {
+		return "", 0, fmt.Errorf("%s must be called with a dataframe, e.g. %s(df)", timeFilterMacro, timeFilterMacro)
+	}
+	i++
+	skipSpaces()
+	if i >= len(script) || !isIdentStart(script[i]) {
+		return "", 0, fmt.Errorf("%s expects a dataframe name", timeFilterMacro)
+	}
+	end := scanIdent(script, i)
+	df := script[i:end]
+	i = end
+	skipSpaces()
+	if i >= len(script) || script[i] != ')' {
+		return "", 0, fmt.Errorf("%s expects a single dataframe name", timeFilterMacro)
+	}
+	return df, i + 1, nil
+}
+
+// expandMacros replaces the Grafana macros in the PxL script with the values
+// of query.
+func expandMacros(script string, query backend.DataQuery) (string, error) {
+	values := macroValues(query)
+	var out strings.Builder
+	out.Grow(len(script))
+
+	for i := 0; i < len(script); {
+		c := script[i]
+		switch {
+		case c == '#':
+			end := strings.IndexByte(script[i:], '\n')
+			if end == -1 {
+				end = len(script) - i
+			}
+			out.WriteString(script[i : i+end])
+			i += end
+		case c == '\'' || c == '"':
+			end := scanString(script, i)
+			out.WriteString(script[i:end])
+			i = end
+		case c == '$' && i+1 < len(script) && isIdentStart(script[i+1]):
+			end := scanIdent(script, i+1)
+			macro := GrafanaMacro(script[i:end])
+			if macro == timeFilterMacro {
+				df, callEnd, err := scanTimeFilter(script, end)
+				if err != nil {
+					return "", err
+				}
+				fmt.Fprintf(&out, "(%s.time_ >= %s and %s.time_ < %s)", df, values[fromMacro], df, values[toMacro])
+				i = callEnd
+				continue
+			}
+			if value, ok := values[macro]; ok {
+				out.WriteString(value)
+			} else {
+				// Leave other template variables untouched.
+				out.WriteString(string(macro))
+			}
+			i = end
+		case isIdentStart(c) || (c >= '0' && c <= '9'):
+			end := scanIdent(script, i)
+			token := script[i:end]
+			attribute := i > 0 && script[i-1] == '.'
+			if value, ok := values[GrafanaMacro(token)]; ok && !attribute {
+				out.WriteString(value)
+			} else {
+				out.WriteString(token)
+			}
+			i = end
+		default:
+			out.WriteByte(c)
+			i++
+		}
+	}
+	return out.String(), nil
+}
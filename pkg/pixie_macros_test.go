@@ -0,0 +1,100 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/assert"
+)
+
+func makeMacroQuery() backend.DataQuery {
+	return backend.DataQuery{
+		Interval: 10 * time.Second,
+		TimeRange: backend.TimeRange{
+			From: time.Unix(100, 0),
+			To:   time.Unix(160, 0),
+		},
+	}
+}
+
+func TestExpandMacros(t *testing.T) {
+	tests := []struct {
+		name     string
+		script   string
+		expected string
+	}{
+		{
+			name:     "time range",
+			script:   "px.DataFrame('http_events', start_time=$__from, end_time=$__to)",
+			expected: "px.DataFrame('http_events', start_time=100000000000, end_time=160000000000)",
+		},
+		{
+			name:     "interval",
+			script:   "px.bin(df.time_, $__interval) / $__interval_ms",
+			expected: "px.bin(df.time_, 10000000000) / 10000",
+		},
+		{
+			name:     "range",
+			script:   "window = $__range",
+			expected: "window = 60000000000",
+		},
+		{
+			name:     "time filter",
+			script:   "df = df[$__timeFilter( df )]",
+			expected: "df = df[(df.time_ >= 100000000000 and df.time_ < 160000000000)]",
+		},
+		{
+			name:     "legacy macros",
+			script:   "start_time=__time_from, end_time=__time_to, step=__interval",
+			expected: "start_time=100000000000, end_time=160000000000, step=10000000000",
+		},
+		{
+			name:     "identifiers and attributes",
+			script:   "my__time_from = df.__interval + __interval_count",
+			expected: "my__time_from = df.__interval + __interval_count",
+		},
+		{
+			name:     "strings and comments",
+			script:   "# uses __time_from\nname = '__time_from $__from'\ndoc = \"\"\"\n$__to\n\"\"\"",
+			expected: "# uses __time_from\nname = '__time_from $__from'\ndoc = \"\"\"\n$__to\n\"\"\"",
+		},
+		{
+			name:     "other template variables",
+			script:   "cluster = $pixieCluster",
+			expected: "cluster = $pixieCluster",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			script, err := expandMacros(test.script, makeMacroQuery())
+			assert.Nil(t, err)
+			assert.Equal(t, test.expected, script)
+		})
+	}
+}
+
+func TestExpandMacrosInvalidTimeFilter(t *testing.T) {
+	for _, script := range []string{"df[$__timeFilter]", "df[$__timeFilter()]", "df[$__timeFilter(df, df2)]"} {
+		_, err := expandMacros(script, makeMacroQuery())
+		assert.NotNil(t, err, script)
+	}
+}
@@ -0,0 +1,144 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// metricsNamespace prefixes the metrics of the plugin.
+const metricsNamespace = "pixie_datasource"
+
+// The kinds of clients whose creation is measured.
+const (
+	clientCloud  = "cloud"
+	clientVizier = "vizier"
+)
+
+// The metrics of the plugin are registered with the default registry, which is
+// served by the SDK on the plugin's metrics endpoint.
+var (
+	queriesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "queries_total",
+		Help:      "Number of queries executed.",
+	}, []string{"query_type"})
+	queryErrorsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "query_errors_total",
+		Help:      "Number of failed queries, by the category of their error.",
+	}, []string{"query_type", "status"})
+	scriptDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "script_duration_seconds",
+		Help:      "Time taken to execute PxL scripts and receive their results.",
+		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"query_type", "cluster"})
+	resultRowsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "result_rows_total",
+		Help:      "Number of rows returned by PxL scripts.",
+	}, []string{"query_type", "cluster"})
+	resultBytesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "result_bytes_total",
+		Help:      "Number of bytes returned by PxL scripts.",
+	}, []string{"query_type", "cluster"})
+	listClustersDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "list_clusters_duration_seconds",
+		Help:      "Time taken to list the clusters visible to the API key.",
+		Buckets:   prometheus.DefBuckets,
+	})
+	cacheRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "cache_requests_total",
+		Help:      "Number of script responses looked up in the cache, by result.",
+	}, []string{"result"})
+	clientCreationDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "client_creation_duration_seconds",
+		Help:      "Time taken to create Pixie Cloud and Vizier clients.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"client"})
+)
+
+// errorStatus returns the category of err for the error metrics.
+func errorStatus(err error) string {
+	var qErr *queryError
+	if errors.As(err, &qErr) {
+		return string(qErr.status)
+	}
+	return "unknown"
+}
+
+// queryTypeOf returns the type of query, or an empty string if its JSON is invalid.
+func queryTypeOf(query backend.DataQuery) QueryType {
+	var qm struct {
+		QueryType QueryType `json:"queryType"`
+	}
+	if err := json.Unmarshal(query.JSON, &qm); err != nil {
+		return ""
+	}
+	return qm.QueryType
+}
+
+// queryTypeLabel returns the label of queryType, or "unknown" for types sent
+// by the query which the plugin doesn't know, so they can't grow the number of series.
+func queryTypeLabel(queryType QueryType) string {
+	switch queryType {
+	case RunScript, GetClusters, GetPods, GetServices, GetNamespaces, GetNodes, RunTraceScript, RunAnnotationScript:
+		return string(queryType)
+	}
+	return "unknown"
+}
+
+// recordQuery counts a query of queryType which failed with err, if not nil.
+func recordQuery(queryType QueryType, err error) {
+	label := queryTypeLabel(queryType)
+	queriesTotal.WithLabelValues(label).Inc()
+	if err != nil {
+		queryErrorsTotal.WithLabelValues(label, errorStatus(err)).Inc()
+	}
+}
+
+// recordScript records the execution of a script of queryType on clusterID
+// which started at start and returned tm's results.
+func recordScript(queryType QueryType, clusterID string, start time.Time, tm *PixieToGrafanaTableMux) {
+	label := queryTypeLabel(queryType)
+	scriptDuration.WithLabelValues(label, clusterID).Observe(time.Since(start).Seconds())
+	numRows, numBytes := tm.size()
+	resultRowsTotal.WithLabelValues(label, clusterID).Add(float64(numRows))
+	resultBytesTotal.WithLabelValues(label, clusterID).Add(float64(numBytes))
+}
+
+// recordCacheRequest counts a lookup of a script response in the cache.
+func recordCacheRequest(hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	cacheRequestsTotal.WithLabelValues(result).Inc()
+}
@@ -0,0 +1,58 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorStatus(t *testing.T) {
+	err := newQueryError(statusTimeout, "script timed out")
+	assert.Equal(t, "timeout", errorStatus(err))
+	assert.Equal(t, "timeout", errorStatus(fmt.Errorf("cluster a: %w", err)))
+	assert.Equal(t, "unknown", errorStatus(errors.New("failed")))
+}
+
+func TestQueryTypeOf(t *testing.T) {
+	assert.Equal(t, GetPods, queryTypeOf(backend.DataQuery{JSON: []byte(`{"queryType": "get-pods"}`)}))
+	assert.Equal(t, QueryType(""), queryTypeOf(backend.DataQuery{JSON: []byte(`{`)}))
+}
+
+func TestRecordQuery(t *testing.T) {
+	queries := testutil.ToFloat64(queriesTotal.WithLabelValues(string(GetNodes)))
+	failures := testutil.ToFloat64(queryErrorsTotal.WithLabelValues(string(GetNodes), string(statusUnavailable)))
+
+	recordQuery(GetNodes, nil)
+	recordQuery(GetNodes, newQueryError(statusUnavailable, "unreachable"))
+	assert.Equal(t, queries+2, testutil.ToFloat64(queriesTotal.WithLabelValues(string(GetNodes))))
+	assert.Equal(t, failures+1, testutil.ToFloat64(queryErrorsTotal.WithLabelValues(string(GetNodes), string(statusUnavailable))))
+
+	// Query types the plugin doesn't know are counted together.
+	unknown := testutil.ToFloat64(queriesTotal.WithLabelValues("unknown"))
+	recordQuery(QueryType("made-up"), nil)
+	recordQuery(QueryType(""), nil)
+	assert.Equal(t, unknown+2, testutil.ToFloat64(queriesTotal.WithLabelValues("unknown")))
+	assert.Equal(t, string(RunTraceScript), queryTypeLabel(RunTraceScript))
+}
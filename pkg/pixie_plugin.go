@@ -22,68 +22,134 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"os"
+	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/datasource"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/instancemgmt"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	"px.dev/pxapi"
 )
 
-const (
-	// Define keys to retrieve configs passed from UI.
-	apiKeyField    = "apiKey"
-	clusterIDField = "clusterId"
-	cloudAddrField = "cloudAddr"
-)
-
 // createPixieDatasource creates a new Pixie datasource.
 func createPixieDatasource() datasource.ServeOpts {
-	ds := &PixieDatasource{}
+	ds := &PixieDatasource{
+		im:                datasource.NewInstanceManager(newPixieInstance),
+		bundledScriptsDir: bundledScriptsPath(),
+		customScriptsDir:  customScriptsPath(),
+	}
 	return datasource.ServeOpts{
-		QueryDataHandler:   ds,
-		CheckHealthHandler: ds,
+		QueryDataHandler:    ds,
+		CheckHealthHandler:  ds,
+		StreamHandler:       ds,
+		CallResourceHandler: ds,
 	}
 }
 
 // PixieDatasource is an instance of a Pixie datasource.
 type PixieDatasource struct {
+	// im caches a pixieInstance per datasource configuration.
+	im instancemgmt.InstanceManager
+	// streams holds the streamQuery of every registered Grafana Live channel path.
+	streams sync.Map
+	// bundledScriptsDir is the directory of the PxL scripts shipped with the plugin.
+	bundledScriptsDir string
+	// customScriptsDir is the directory of custom PxL scripts of the server, if any.
+	customScriptsDir string
+}
+
+// bundledScriptsPath returns the directory of the bundled PxL scripts, which
+// the frontend build copies next to the plugin executable.
+func bundledScriptsPath() string {
+	executable, err := os.Executable()
+	if err != nil {
+		log.DefaultLogger.Warn(fmt.Sprintf("Unable to locate the plugin executable: %v", err))
+		return bundledScriptsDir
+	}
+	return filepath.Join(filepath.Dir(executable), bundledScriptsDir)
 }
 
 // QueryData implements Grafana's public API for querying data.
 // Can receive multiple queries and return multiple dataframes.
 func (td *PixieDatasource) QueryData(ctx context.Context, req *backend.QueryDataRequest) (
 	*backend.QueryDataResponse, error) {
+	ctx, span := tracer.Start(requestContext(ctx), "QueryData")
+	defer span.End()
+
 	response := backend.NewQueryDataResponse()
-	// Loop over queries and execute them individually. Save the response
-	// in a hashmap with RefID as identifier.
-	for _, q := range req.Queries {
-		dataSourceSettings := req.PluginContext.DataSourceInstanceSettings
-		jsonData := dataSourceSettings.JSONData
-		secureJsonData := dataSourceSettings.DecryptedSecureJSONData
-
-		var jsonDataMap map[string]interface{}
-		err := json.Unmarshal(jsonData, &jsonDataMap)
-		if err != nil {
-			return nil, fmt.Errorf("error unmarshalling JSON: %v", err)
+	instance, err := td.getInstance(req.PluginContext)
+	if err != nil {
+		// Invalid settings fail every query of the request.
+		for _, q := range req.Queries {
+			response.Responses[q.RefID] = backend.DataResponse{
+				Error: newQueryError(statusBadRequest, "%v", err),
+			}
 		}
+		return response, nil
+	}
 
-		res, err := td.query(ctx, q, jsonDataMap, secureJsonData)
-		if err != nil {
-			return response, err
+	// Alert rules are evaluated by Grafana's server without the frontend.
+	alerting := req.Headers[fromAlertHeader] == "true"
+
+	// Execute the queries concurrently, at most maxConcurrentQueries at a time.
+	results := make([]*backend.DataResponse, len(req.Queries))
+	errs := make([]error, len(req.Queries))
+	sem := make(chan struct{}, instance.settings.MaxConcurrentQueries)
+	var wg sync.WaitGroup
+	for idx, q := range req.Queries {
+		wg.Add(1)
+		go func(idx int, q backend.DataQuery) {
+			defer wg.Done()
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			ctx, span := tracer.Start(ctx, "query", trace.WithAttributes(attribute.String("ref_id", q.RefID)))
+			results[idx], errs[idx] = td.query(ctx, q, instance, alerting)
+			endSpan(span, errs[idx])
+		}(idx, q)
+	}
+	wg.Wait()
+
+	// Save the responses in a hashmap with RefID as identifier. A failed query
+	// only fails its own response so the other queries still render.
+	for idx, q := range req.Queries {
+		err := errs[idx]
+		if err == nil && results[idx].Error != nil {
+			err = results[idx].Error
 		}
-		response.Responses[q.RefID] = *res
+		recordQuery(queryTypeOf(q), err)
+		if errs[idx] != nil {
+			log.DefaultLogger.Error(fmt.Sprintf("Query %s failed: %v", q.RefID, errs[idx]))
+			response.Responses[q.RefID] = backend.DataResponse{Error: errs[idx]}
+			continue
+		}
+		response.Responses[q.RefID] = *results[idx]
 	}
 
 	return response, nil
 }
 
+// getInstance returns the cached pixieInstance for the datasource in pluginContext.
+func (td *PixieDatasource) getInstance(pluginContext backend.PluginContext) (*pixieInstance, error) {
+	instance, err := td.im.Get(pluginContext)
+	if err != nil {
+		return nil, err
+	}
+	return instance.(*pixieInstance), nil
+}
+
 // Creates Pixie API client using API key and cloud Address
 func createClient(ctx context.Context, apiKey string, cloudAddr string) (*pxapi.Client, error) {
 	// untrimmed apiKey string will cause an error when creating a client
 	apiKey = strings.TrimSpace(apiKey)
 
+	ctx, span := tracer.Start(ctx, "createClient")
 	var client *pxapi.Client
 	var err error
 	// First, create a client connecting to Pixie Cloud.
@@ -92,6 +158,7 @@ func createClient(ctx context.Context, apiKey string, cloudAddr string) (*pxapi.
 	} else {
 		client, err = pxapi.NewClient(ctx, pxapi.WithAPIKey(apiKey), pxapi.WithCloudAddr(cloudAddr))
 	}
+	endSpan(span, err)
 	if err != nil {
 		return nil, err
 	}
@@ -99,6 +166,41 @@ func createClient(ctx context.Context, apiKey string, cloudAddr string) (*pxapi.
 	return client, nil
 }
 
+// queryStatus describes why a query failed.
+type queryStatus string
+
+const (
+	// statusBadRequest means the query itself is invalid.
+	statusBadRequest queryStatus = "bad request"
+	// statusUnavailable means Pixie Cloud or the Vizier could not be reached.
+	statusUnavailable queryStatus = "unavailable"
+	// statusScriptError means the PxL script failed to compile or execute.
+	statusScriptError queryStatus = "script error"
+	// statusTimeout means the PxL script did not finish within its timeout.
+	statusTimeout queryStatus = "timeout"
+	// statusInternal means the results could not be converted to frames.
+	statusInternal queryStatus = "internal error"
+)
+
+// queryError is the error of a single query, reported in its DataResponse.
+type queryError struct {
+	status queryStatus
+	err    error
+}
+
+func (e *queryError) Error() string {
+	return fmt.Sprintf("%s: %v", e.status, e.err)
+}
+
+func (e *queryError) Unwrap() error {
+	return e.err
+}
+
+// newQueryError creates a queryError with the given status and formatted message.
+func newQueryError(status queryStatus, format string, a ...interface{}) error {
+	return &queryError{status: status, err: fmt.Errorf(format, a...)}
+}
+
 // Specifies available query types
 type QueryType string
 
@@ -109,6 +211,10 @@ const (
 	GetServices   QueryType = "get-services"
 	GetNamespaces QueryType = "get-namespaces"
 	GetNodes      QueryType = "get-nodes"
+	// RunTraceScript runs a script returning spans, shown by Grafana's trace view.
+	RunTraceScript QueryType = "run-trace-script"
+	// RunAnnotationScript runs a script returning the annotations of dashboards.
+	RunAnnotationScript QueryType = "run-annotation-script"
 )
 
 const (
@@ -144,58 +250,139 @@ px.display(df.groupby('node').agg())
 `
 )
 
+const (
+	// fromAlertHeader is set by Grafana on the requests of alert rule evaluations.
+	fromAlertHeader = "FromAlert"
+	// defaultMaxDataPoints is used to derive the interval of queries without one.
+	defaultMaxDataPoints = 1000
+)
+
 type queryBody struct {
 	// The body of a pxl script
 	PxlScript string
 	ClusterID string `json:"clusterID"`
+	// ClusterIDs runs the query on several clusters, or on every connected
+	// cluster for allClusters, instead of ClusterID.
+	ClusterIDs []string `json:"clusterIDs"`
 }
 
 type queryModel struct {
 	// QueryType specifies which API call to call.
 	QueryType QueryType `json:"queryType"`
+	// ClusterID is the cluster selected in the query editor.
+	ClusterID string `json:"clusterID"`
 	// QueryBody contains any additional information needed to make the API call
 	QueryBody queryBody `json:"queryBody"`
+	// Timeout overrides the datasource's query timeout, in seconds.
+	Timeout int `json:"timeout"`
+	// Streaming pushes the script's results to the panel over Grafana Live.
+	Streaming bool `json:"streaming"`
+	// StreamInterval is the time in seconds between two executions of a streamed script.
+	StreamInterval int `json:"streamInterval"`
+	// ExpandUPIDs adds the agent ID, PID and start time of UPID columns as fields.
+	ExpandUPIDs bool `json:"expandUPIDs"`
+	// NoCache runs the query's script without the datasource's response cache.
+	NoCache bool `json:"noCache"`
+	// IncludeDisconnected lists the disconnected clusters in get-clusters queries.
+	IncludeDisconnected bool `json:"includeDisconnected"`
+	frameOptions
+}
+
+// resolveClusterID returns the cluster a query runs on: the query body's
+// cluster, then the query editor's cluster, then the datasource's default
+// cluster. Template variables left unresolved, which happens when the frontend
+// didn't interpolate the query, e.g. for alert rules, are skipped.
+func resolveClusterID(qm queryModel, settings *pixieSettings) string {
+	for _, clusterID := range []string{qm.QueryBody.ClusterID, qm.ClusterID, settings.ClusterID} {
+		// untrimmed clusterID string will cause an error when creating a vizier client
+		clusterID = strings.TrimSpace(clusterID)
+		if clusterID != "" && !strings.HasPrefix(clusterID, "$") {
+			return clusterID
+		}
+	}
+	return ""
+}
+
+// queryInterval returns the interval of query, deriving one from its time
+// range and max data points when Grafana didn't set it.
+func queryInterval(query backend.DataQuery) time.Duration {
+	if query.Interval > 0 {
+		return query.Interval
+	}
+	maxDataPoints := query.MaxDataPoints
+	if maxDataPoints <= 0 {
+		maxDataPoints = defaultMaxDataPoints
+	}
+	interval := query.TimeRange.Duration() / time.Duration(maxDataPoints)
+	if interval < time.Second {
+		return time.Second
+	}
+	return interval.Truncate(time.Second)
 }
 
 // Handle an incoming query
 func (td *PixieDatasource) query(ctx context.Context, query backend.DataQuery,
-	config map[string]interface{}, decryptedConfig map[string]string) (*backend.DataResponse, error) {
-
-	cloudAddr := config[cloudAddrField].(string)
+	instance *pixieInstance, alerting bool) (*backend.DataResponse, error) {
 
-	apiToken := decryptedConfig[apiKeyField]
-	clusterID := decryptedConfig[clusterIDField]
 	var qm queryModel
 	if err := json.Unmarshal(query.JSON, &qm); err != nil {
-		return nil, fmt.Errorf("error unmarshalling JSON: %v", err)
+		return nil, newQueryError(statusBadRequest, "error unmarshalling JSON: %v", err)
+	}
+	if err := qm.frameOptions.validate(); err != nil {
+		return nil, newQueryError(statusBadRequest, "%v", err)
 	}
 
-	client, err := createClient(ctx, apiToken, cloudAddr)
-	if err != nil {
-		return nil, fmt.Errorf("error creating Pixie Client: %v", err)
+	if _, err := instance.getClient(ctx); err != nil {
+		return nil, newQueryError(statusUnavailable, "error creating Pixie Client: %v", err)
 	}
 
-	qp := PixieQueryProcessor{
-		client: client,
+	timeout := instance.settings.QueryTimeout
+	if qm.Timeout > 0 {
+		timeout = qm.Timeout
 	}
 
-	// if cluster id is not set, fall back to using id from config
-	if len(qm.QueryBody.ClusterID) != 0 {
-		clusterID = qm.QueryBody.ClusterID
+	qp := PixieQueryProcessor{
+		instance:     instance,
+		queryType:    qm.QueryType,
+		timeout:      time.Duration(timeout) * time.Second,
+		alerting:     alerting,
+		expandUPIDs:  qm.ExpandUPIDs,
+		noCache:      qm.NoCache,
+		frameOptions: qm.frameOptions,
 	}
+	query.Interval = queryInterval(query)
 
-	// untrimmed clusterID string will cause an error when creating a vizier client
-	clusterID = strings.TrimSpace(clusterID)
+	if len(qm.QueryBody.ClusterIDs) > 0 && qm.QueryType != GetClusters {
+		if qm.Streaming && !alerting {
+			return nil, newQueryError(statusBadRequest, "streamed queries can only run on a single cluster")
+		}
+		return td.queryFanOut(ctx, qp, qm, query)
+	}
 
-	if qm.QueryType != GetClusters && (len(qm.QueryBody.ClusterID) == 0 && clusterID == "") {
-		return nil, fmt.Errorf("no clusterID present in the request or default clusterID configured. Please set `pixieCluster` dashboard variable to `Pixie Datasource`->`Clusters`")
+	clusterID := resolveClusterID(qm, instance.settings)
+	if qm.QueryType != GetClusters && clusterID == "" {
+		return nil, newQueryError(statusBadRequest, "no clusterID present in the request or default clusterID configured. Please set `pixieCluster` dashboard variable to `Pixie Datasource`->`Clusters`")
 	}
+	return td.runQuery(ctx, qp, qm, query, clusterID)
+}
+
+// runQuery runs the query on the cluster.
+func (td *PixieDatasource) runQuery(ctx context.Context, qp PixieQueryProcessor, qm queryModel,
+	query backend.DataQuery, clusterID string) (*backend.DataResponse, error) {
 
 	switch qm.QueryType {
 	case RunScript:
+		// Alert rules are evaluated once per interval and can't be streamed.
+		if qm.Streaming && !qp.alerting {
+			return td.queryStream(ctx, qp, qm, query, clusterID)
+		}
 		return qp.queryScript(ctx, qm.QueryBody.PxlScript, query, clusterID)
+	case RunTraceScript:
+		return qp.queryConvertedTables(ctx, qm.QueryBody.PxlScript, query, clusterID, traceFrame)
+	case RunAnnotationScript:
+		return qp.queryConvertedTables(ctx, qm.QueryBody.PxlScript, query, clusterID, annotationFrame)
 	case GetClusters:
-		return qp.queryClusters(ctx)
+		return qp.queryClusters(ctx, qm.IncludeDisconnected)
 	case GetPods:
 		return qp.queryScript(ctx, getPodsScript, query, clusterID)
 	case GetServices:
@@ -205,41 +392,6 @@ func (td *PixieDatasource) query(ctx context.Context, query backend.DataQuery,
 	case GetNodes:
 		return qp.queryScript(ctx, getNodesScript, query, clusterID)
 	default:
-		return nil, fmt.Errorf("unknown query type: %v", qm.QueryType)
-	}
-}
-
-// CheckHealth implements the Grafana service health check API.
-func (td *PixieDatasource) CheckHealth(ctx context.Context, req *backend.CheckHealthRequest) (*backend.CheckHealthResult, error) {
-	status := backend.HealthStatusOk
-	message := "Connection to Pixie cluster successfully configured"
-	config := req.PluginContext.DataSourceInstanceSettings.DecryptedSecureJSONData
-
-	var client *pxapi.Client
-	var err error
-
-	if status == backend.HealthStatusOk {
-		client, err = createClient(ctx, config[apiKeyField], config[cloudAddrField])
-		if err != nil {
-			message = fmt.Sprintf("Error connecting Pixie client: %s", err.Error())
-			status = backend.HealthStatusError
-		}
-	}
-
-	if status == backend.HealthStatusOk {
-		// only check the health of clusterID if the user specified clusterID
-		if len(config[clusterIDField]) != 0 {
-			_, err = client.NewVizierClient(ctx, config[clusterIDField])
-			if err != nil {
-				message = fmt.Sprintf("Unable to create Vizier Client: %+v, clusterID: '%+v'", err, config[clusterIDField])
-				status = backend.HealthStatusError
-			}
-		}
+		return nil, newQueryError(statusBadRequest, "unknown query type: %v", qm.QueryType)
 	}
-
-	log.DefaultLogger.Warn(message)
-	return &backend.CheckHealthResult{
-		Status:  status,
-		Message: message,
-	}, nil
 }
@@ -0,0 +1,295 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/datasource"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/assert"
+
+	"px.dev/pxapi"
+	"px.dev/pxapi/proto/vizierpb"
+	"px.dev/pxapi/types"
+)
+
+func makeQueryDataRequest(queries ...backend.DataQuery) *backend.QueryDataRequest {
+	return &backend.QueryDataRequest{
+		PluginContext: backend.PluginContext{
+			DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{
+				ID:                      1,
+				JSONData:                []byte(`{"cloudAddr": ""}`),
+				DecryptedSecureJSONData: map[string]string{apiKeyField: "key"},
+			},
+		},
+		Queries: queries,
+	}
+}
+
+func TestQueryDataPerQueryErrors(t *testing.T) {
+	ds := &PixieDatasource{
+		im: datasource.NewInstanceManager(newPixieInstance),
+	}
+	req := makeQueryDataRequest(
+		backend.DataQuery{RefID: "A", JSON: []byte(`{"queryType": `)},
+		backend.DataQuery{RefID: "B", JSON: []byte(`not json`)},
+	)
+
+	resp, err := ds.QueryData(context.Background(), req)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(resp.Responses))
+
+	for _, refID := range []string{"A", "B"} {
+		var qErr *queryError
+		assert.True(t, errors.As(resp.Responses[refID].Error, &qErr))
+		assert.Equal(t, statusBadRequest, qErr.status)
+	}
+}
+
+func TestQueryDataInvalidSettings(t *testing.T) {
+	ds := &PixieDatasource{
+		im: datasource.NewInstanceManager(newPixieInstance),
+	}
+	req := makeQueryDataRequest(backend.DataQuery{RefID: "A", JSON: []byte(`{"queryType": "get-clusters"}`)})
+	req.PluginContext.DataSourceInstanceSettings.DecryptedSecureJSONData = map[string]string{}
+
+	resp, err := ds.QueryData(context.Background(), req)
+	assert.Nil(t, err)
+	assert.NotNil(t, resp.Responses["A"].Error)
+}
+
+func TestQueryDataAlertWithoutCluster(t *testing.T) {
+	ds := &PixieDatasource{
+		im: datasource.NewInstanceManager(newPixieInstance),
+	}
+	// Alert rules send the query as saved by the query editor, without
+	// interpolating the dashboard variables.
+	req := makeQueryDataRequest(backend.DataQuery{
+		RefID: "A",
+		JSON:  []byte(`{"queryType": "run-script", "queryBody": {"clusterID": "$pixieCluster", "pxlScript": "import px"}}`),
+		TimeRange: backend.TimeRange{
+			From: time.Now().Add(-5 * time.Minute),
+			To:   time.Now(),
+		},
+	})
+	req.Headers = map[string]string{fromAlertHeader: "true"}
+
+	resp, err := ds.QueryData(context.Background(), req)
+	assert.Nil(t, err)
+	var qErr *queryError
+	assert.True(t, errors.As(resp.Responses["A"].Error, &qErr))
+	assert.Equal(t, statusBadRequest, qErr.status)
+}
+
+func TestQueryDataAlertSavedCluster(t *testing.T) {
+	cloud := &fakeCloudClient{newVizier: func(ctx context.Context, clusterID string) (vizierClient, error) {
+		return &fakeVizierClient{run: func(ctx context.Context, pxlScript string, mux pxapi.TableMuxer) error {
+			metadata := makeTableMetadata(vizierpb.TIME64NS, vizierpb.STRING, vizierpb.FLOAT64)
+			var records []*types.Record
+			for idx, service := range []string{"cart", "checkout"} {
+				timeVal := types.NewTime64NSValue(&metadata.ColInfo[0])
+				timeVal.ScanInt64(int64(time.Second))
+				serviceVal := types.NewStringValue(&metadata.ColInfo[1])
+				serviceVal.ScanString(service)
+				errorRateVal := types.NewFloat64Value(&metadata.ColInfo[2])
+				errorRateVal.ScanFloat64(float64(idx) / 10)
+				records = append(records, &types.Record{
+					Data:          []types.Datum{timeVal, serviceVal, errorRateVal},
+					TableMetadata: metadata,
+				})
+			}
+			return sendTable(ctx, mux, metadata, records)
+		}}, nil
+	}}
+	ds := newFakeDatasource(cloud)
+	// The cluster saved by the query editor is used as the variable isn't interpolated.
+	req := makeQueryDataRequest(backend.DataQuery{
+		RefID: "A",
+		JSON: []byte(`{"queryType": "run-script", "clusterID": "saved-cluster",
+			"queryBody": {"clusterID": "$pixieCluster", "pxlScript": "import px"}}`),
+		TimeRange: backend.TimeRange{
+			From: time.Now().Add(-5 * time.Minute),
+			To:   time.Now(),
+		},
+	})
+	req.Headers = map[string]string{fromAlertHeader: "true"}
+
+	resp, err := ds.QueryData(context.Background(), req)
+	assert.Nil(t, err)
+	assert.Nil(t, resp.Responses["A"].Error)
+	assert.Equal(t, map[string]int{"saved-cluster": 1}, cloud.vizierClients)
+	frames := resp.Responses["A"].Frames
+	assert.Equal(t, 1, len(frames))
+	assert.Equal(t, data.TimeSeriesTypeWide, frames[0].TimeSeriesSchema().Type)
+	assert.Equal(t, 3, len(frames[0].Fields))
+	assert.Equal(t, data.Labels{"Column 1": "cart"}, frames[0].Fields[1].Labels)
+}
+
+func TestQueryDataTimeout(t *testing.T) {
+	stop := make(chan struct{})
+	defer close(stop)
+	cloud := &fakeCloudClient{newVizier: func(ctx context.Context, clusterID string) (vizierClient, error) {
+		return &fakeVizierClient{run: func(ctx context.Context, pxlScript string, mux pxapi.TableMuxer) error {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-stop:
+				return nil
+			}
+		}}, nil
+	}}
+	ds := newFakeDatasource(cloud)
+
+	// The query's timeout overrides the datasource's.
+	req := makeQueryDataRequest(backend.DataQuery{
+		RefID: "A",
+		JSON:  []byte(`{"queryType": "run-script", "clusterID": "cluster-a", "timeout": 1, "queryBody": {"pxlScript": "import px"}}`),
+	})
+	req.PluginContext.DataSourceInstanceSettings.JSONData = []byte(`{"cloudAddr": "", "queryTimeout": 60}`)
+	resp, err := ds.QueryData(context.Background(), req)
+	assert.Nil(t, err)
+	var qErr *queryError
+	assert.True(t, errors.As(resp.Responses["A"].Error, &qErr))
+	assert.Equal(t, statusTimeout, qErr.status)
+	assert.Equal(t, "script timed out after 1 s", qErr.err.Error())
+
+	// The request's own deadline isn't reported as the script's timeout.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req = makeQueryDataRequest(backend.DataQuery{
+		RefID: "A",
+		JSON:  []byte(`{"queryType": "run-script", "clusterID": "cluster-a", "queryBody": {"pxlScript": "import px"}}`),
+	})
+	req.PluginContext.DataSourceInstanceSettings.JSONData = []byte(`{"cloudAddr": "", "queryTimeout": 60}`)
+	resp, err = ds.QueryData(ctx, req)
+	assert.Nil(t, err)
+	assert.True(t, errors.As(resp.Responses["A"].Error, &qErr))
+	assert.Equal(t, statusTimeout, qErr.status)
+	assert.NotContains(t, qErr.Error(), "script timed out")
+}
+
+func TestResolveClusterID(t *testing.T) {
+	settings := &pixieSettings{ClusterID: "default-cluster"}
+	tests := []struct {
+		name     string
+		qm       queryModel
+		expected string
+	}{
+		{name: "query body", qm: queryModel{ClusterID: "editor", QueryBody: queryBody{ClusterID: " body "}}, expected: "body"},
+		{name: "query editor", qm: queryModel{ClusterID: "editor"}, expected: "editor"},
+		{name: "unresolved variable", qm: queryModel{QueryBody: queryBody{ClusterID: "$pixieCluster"}}, expected: "default-cluster"},
+		{name: "default", qm: queryModel{}, expected: "default-cluster"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert.Equal(t, test.expected, resolveClusterID(test.qm, settings))
+		})
+	}
+	assert.Equal(t, "", resolveClusterID(queryModel{}, &pixieSettings{}))
+}
+
+func TestQueryInterval(t *testing.T) {
+	timeRange := backend.TimeRange{From: time.Unix(0, 0), To: time.Unix(3600, 0)}
+	assert.Equal(t, 5*time.Second, queryInterval(backend.DataQuery{Interval: 5 * time.Second, TimeRange: timeRange}))
+	assert.Equal(t, 3*time.Second, queryInterval(backend.DataQuery{TimeRange: timeRange}))
+	assert.Equal(t, 36*time.Second, queryInterval(backend.DataQuery{TimeRange: timeRange, MaxDataPoints: 100}))
+	assert.Equal(t, time.Second, queryInterval(backend.DataQuery{}))
+}
+
+func TestTableFramesAlerting(t *testing.T) {
+	metadata := makeTableMetadata(vizierpb.TIME64NS, vizierpb.STRING, vizierpb.FLOAT64, vizierpb.TIME64NS)
+	var recordLst []*types.Record
+	for idx, service := range []string{"cart", "checkout", "cart", "checkout"} {
+		timeVal := types.NewTime64NSValue(&metadata.ColInfo[0])
+		timeVal.ScanInt64(int64(idx/2) * int64(time.Second))
+		serviceVal := types.NewStringValue(&metadata.ColInfo[1])
+		serviceVal.ScanString(service)
+		errorRateVal := types.NewFloat64Value(&metadata.ColInfo[2])
+		errorRateVal.ScanFloat64(float64(idx) / 10)
+		otherTimeVal := types.NewTime64NSValue(&metadata.ColInfo[3])
+		otherTimeVal.ScanInt64(0)
+		recordLst = append(recordLst, &types.Record{
+			Data:          []types.Datum{timeVal, serviceVal, errorRateVal, otherTimeVal},
+			TableMetadata: metadata,
+		})
+	}
+	tm := &PixieToGrafanaTableMux{}
+	tableMuxAcceptTableAndHandleRecord(t, tm, metadata, recordLst)
+
+	// Without a time_ column, regular queries keep the table as-is.
+	frames, err := PixieQueryProcessor{}.tableFrames(context.Background(), tm)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(frames))
+	assert.Equal(t, 4, len(frames[0].Fields))
+
+	frames, err = PixieQueryProcessor{alerting: true}.tableFrames(context.Background(), tm)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(frames))
+	assert.Equal(t, data.TimeSeriesTypeWide, frames[0].TimeSeriesSchema().Type)
+	// One time field and one numeric field per service.
+	assert.Equal(t, 3, len(frames[0].Fields))
+	assert.Equal(t, data.FieldTypeTime, frames[0].Fields[0].Type())
+	assert.Equal(t, data.Labels{"Column 1": "cart"}, frames[0].Fields[1].Labels)
+	assert.Equal(t, data.Labels{"Column 1": "checkout"}, frames[0].Fields[2].Labels)
+}
+
+func TestTableFramesTimeSeriesWithoutTime(t *testing.T) {
+	metadata := makeTableMetadata(vizierpb.STRING, vizierpb.FLOAT64)
+	serviceVal := types.NewStringValue(&metadata.ColInfo[0])
+	serviceVal.ScanString("cart")
+	errorRateVal := types.NewFloat64Value(&metadata.ColInfo[1])
+	errorRateVal.ScanFloat64(0.1)
+	tm := &PixieToGrafanaTableMux{}
+	tableMuxAcceptTableAndHandleRecord(t, tm, metadata, []*types.Record{{
+		Data:          []types.Datum{serviceVal, errorRateVal},
+		TableMetadata: metadata,
+	}})
+
+	// Tables without a time column are kept as-is instead of failing the query.
+	for _, format := range []frameFormat{formatTimeSeriesLong, formatTimeSeriesWide} {
+		frames, err := PixieQueryProcessor{frameOptions: frameOptions{Format: format}}.tableFrames(context.Background(), tm)
+		assert.Nil(t, err)
+		assert.Equal(t, 1, len(frames))
+		assert.Equal(t, 2, len(frames[0].Fields))
+		assert.Equal(t, "cart", frames[0].Fields[0].At(0))
+	}
+}
+
+func TestClustersFrame(t *testing.T) {
+	viziers := []*pxapi.VizierInfo{
+		{ID: "1", Name: "staging", Version: "0.14.2", Status: pxapi.VizierStatusHealthy},
+		{ID: "2", Name: "production", Version: "0.14.1", Status: pxapi.VizierStatusDisconnected, DirectAccess: true},
+	}
+
+	frame := clustersFrame(viziers, false)
+	assert.Equal(t, 1, frame.Rows())
+	assert.Equal(t, 5, len(frame.Fields))
+	assert.Equal(t, "Healthy", frame.Fields[2].At(0))
+	assert.Equal(t, "0.14.2", frame.Fields[3].At(0))
+
+	frame = clustersFrame(viziers, true)
+	assert.Equal(t, 2, frame.Rows())
+	assert.Equal(t, "Disconnected", frame.Fields[2].At(1))
+	assert.Equal(t, true, frame.Fields[4].At(1))
+}
@@ -20,52 +20,58 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"strings"
 	"time"
 
 	"github.com/grafana/grafana-plugin-sdk-go/backend"
 	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
 	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 
 	"px.dev/pxapi"
 )
 
-// GrafanaMacro is a type which defines a macro.
-type GrafanaMacro string
-
-const (
-	// timeFromMacro is the start of the time range of a query.
-	timeFromMacro GrafanaMacro = "__time_from"
-	// timeToMacro is the end of the time range of a query.
-	timeToMacro GrafanaMacro = "__time_to"
-	// intervalMacro is the suggested duration between time points.
-	intervalMacro GrafanaMacro = "__interval"
-)
-
-// replaceTimeMacroInQueryText takes the query text (PxL script to execute)
-// and replaces the time macros with the relevant time objects.
-func replaceTimeMacroInQueryText(queryText string, grafanaMacro GrafanaMacro,
-	timeReplacement time.Time) string {
-	tStr := fmt.Sprintf("%d", timeReplacement.UnixNano())
-	return strings.ReplaceAll(queryText, string(grafanaMacro), tStr)
+// PixieQueryProcessor is a type which handles different PixieAPI calls and returns a Grafana response
+type PixieQueryProcessor struct {
+	instance *pixieInstance
+	// queryType is the type of the query, recorded in the metrics.
+	queryType QueryType
+	// timeout bounds the execution of a PxL script.
+	timeout time.Duration
+	// alerting formats the results for Grafana's alert conditions.
+	alerting bool
+	// expandUPIDs adds the agent ID, PID and start time of UPIDs as fields.
+	expandUPIDs bool
+	// noCache runs scripts without the response cache of the instance.
+	noCache bool
+	// frameOptions shapes the tables into frames.
+	frameOptions frameOptions
 }
 
-// replaceIntervalMacroInQueryText takes the query text and replaces
-// interval macro with interval duration specified in Grafana UI.
-func replaceIntervalMacroInQueryText(queryText string, grafanaMacro GrafanaMacro,
-	intervalDuration time.Duration) string {
-	intervalStr := fmt.Sprintf("%d", intervalDuration.Nanoseconds())
-	return strings.ReplaceAll(queryText, string(grafanaMacro), intervalStr)
+// scriptError wraps an error returned while executing a PxL script, reporting
+// a timeout if scriptCtx, the script's own timeout context, fired while its
+// parent was still running.
+func (qp PixieQueryProcessor) scriptError(parent context.Context, scriptCtx context.Context, format string, err error) error {
+	if errors.Is(scriptCtx.Err(), context.DeadlineExceeded) && parent.Err() == nil {
+		return newQueryError(statusTimeout, "script timed out after %d s", int(qp.timeout.Seconds()))
+	}
+	return newQueryError(statusScriptError, format, err)
 }
 
-// PixieQueryProcessor is a type which handles different PixieAPI calls and returns a Grafana response
-type PixieQueryProcessor struct {
-	client *pxapi.Client
+// canceledError returns the error of a query whose ctx was done before its script finished.
+func canceledError(ctx context.Context) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return newQueryError(statusTimeout, "request deadline exceeded before the script finished")
+	}
+	return newQueryError(statusScriptError, "query canceled: %v", ctx.Err())
 }
 
-// queryScript sends a request to Pixie with pxlScript and returns DataResponse about the current cluster
+// queryScript sends a request to Pixie with pxlScript and returns DataResponse about the current cluster.
+// Responses are served from the cache of the instance when it is enabled, over
+// the time range of the query truncated to the cache's TTL.
 func (qp PixieQueryProcessor) queryScript(
 	ctx context.Context,
 	pxlScript string,
@@ -73,90 +79,281 @@ func (qp PixieQueryProcessor) queryScript(
 	clusterID string,
 ) (*backend.DataResponse, error) {
 
-	vz, err := qp.client.NewVizierClient(ctx, clusterID)
+	cache := qp.instance.cache
+	if qp.noCache {
+		cache = nil
+	}
+	if cache != nil {
+		query.TimeRange = cache.bucket(query.TimeRange)
+	}
+	// Update macros in query text.
+	pxlScript, err := expandMacros(pxlScript, query)
+	if err != nil {
+		return nil, newQueryError(statusBadRequest, "invalid macro: %v", err)
+	}
+	if cache == nil {
+		return qp.executeShared(ctx, pxlScript, query, clusterID)
+	}
+
+	key, err := qp.cacheKey(pxlScript, clusterID, query.TimeRange)
+	if err != nil {
+		return nil, newQueryError(statusInternal, "unable to compute the cache key: %v", err)
+	}
+	if frames, ok := cache.get(key, time.Now()); ok {
+		recordCacheRequest(true)
+		return &backend.DataResponse{Frames: frames}, nil
+	}
+	recordCacheRequest(false)
+	response, err := qp.executeShared(ctx, pxlScript, query, clusterID)
+	if err != nil || response.Error != nil {
+		return response, err
+	}
+	if err := cache.set(key, response.Frames, time.Now()); err != nil {
+		log.DefaultLogger.Warn(fmt.Sprintf("Unable to cache the response of query %s: %v", query.RefID, err))
+	}
+	return response, nil
+}
+
+// executeScript runs the rendered pxlScript on the cluster and returns its frames.
+func (qp PixieQueryProcessor) executeScript(
+	ctx context.Context,
+	pxlScript string,
+	query backend.DataQuery,
+	clusterID string,
+) (*backend.DataResponse, error) {
+
+	vz, err := qp.instance.getVizierClient(ctx, clusterID)
 	if err != nil {
 		log.DefaultLogger.Error(fmt.Sprintf("Unable to create Vizier Client: %+v, clusterID: '%+v'", err, clusterID))
-		return nil, err
+		return nil, newQueryError(statusUnavailable, "unable to create Vizier Client for cluster '%s': %v", clusterID, err)
 	}
 
 	response := &backend.DataResponse{}
 
+	parent := ctx
+	ctx, cancel := context.WithTimeout(ctx, qp.timeout)
+	defer cancel()
+
 	// Create TableMuxer to accept results table.
-	tm := &PixieToGrafanaTableMux{}
-	// Update macros in query text.
-	pxlScript = replaceTimeMacroInQueryText(pxlScript, timeFromMacro,
-		query.TimeRange.From)
-	pxlScript = replaceTimeMacroInQueryText(pxlScript, timeToMacro,
-		query.TimeRange.To)
-	pxlScript = replaceIntervalMacroInQueryText(pxlScript, intervalMacro,
-		query.Interval)
+	tm := &PixieToGrafanaTableMux{
+		limits:         qp.instance.settings.resultLimits(),
+		expandUPIDs:    qp.expandUPIDs,
+		timeColumn:     qp.frameOptions.TimeColumn,
+		ratesPerSecond: qp.frameOptions.RatesPerSecond,
+	}
 
 	// Execute the PxL script.
-	resultSet, err := vz.ExecuteScript(ctx, pxlScript, tm)
+	start := time.Now()
+	attributes := trace.WithAttributes(attribute.String("query_type", string(qp.queryType)), attribute.String("cluster_id", clusterID))
+	execCtx, span := tracer.Start(ctx, "ExecuteScript", attributes)
+	resultSet, err := vz.ExecuteScript(execCtx, pxlScript, tm)
 	if err != nil && err != io.EOF {
+		endSpan(span, err)
+		if isConnectionError(err) {
+			qp.instance.evictVizierClient(clusterID, vz)
+		}
 		log.DefaultLogger.Warn("Can't execute script.")
-		return nil, err
+		return nil, qp.scriptError(parent, ctx, "can't execute script: %v", err)
 	}
+	span.End()
 
 	// Receive the PxL script results.
 	defer resultSet.Close()
-	if err := resultSet.Stream(); err != nil {
-		streamStrErr := fmt.Errorf("got error : %+v, while streaming", err)
-		response.Error = streamStrErr
-		log.DefaultLogger.Error(streamStrErr.Error())
+	_, span = tracer.Start(ctx, "Stream", attributes)
+	err = resultSet.Stream()
+	endSpan(span, err)
+	if err != nil {
+		if isConnectionError(err) {
+			qp.instance.evictVizierClient(clusterID, vz)
+		}
+		if tm.truncated() {
+			// The results exceeded the query's limits, the frames carry a notice.
+			log.DefaultLogger.Warn(fmt.Sprintf("Truncated the results of query %s", query.RefID))
+		} else {
+			streamStrErr := qp.scriptError(parent, ctx, "got error : %+v, while streaming", err)
+			response.Error = streamStrErr
+			log.DefaultLogger.Error(streamStrErr.Error())
+		}
+	}
+	recordScript(qp.queryType, clusterID, start, tm)
+	if err := tm.finish(ctx); err != nil {
+		return nil, newQueryError(statusInternal, "unable to create frames: %v", err)
 	}
 
 	// Add the frames to the response.
-	for _, tablePrinter := range tm.pxTablePrinterLst {
-		// If time series schema long && time_ column && table not empty, convert to wide. Otherwise
-		// proceed as normal.
-		tsSchema := tablePrinter.frame.TimeSeriesSchema()
-		numRows, err := tablePrinter.frame.RowLen()
+	frames, err := qp.tableFrames(ctx, tm)
+	if err != nil {
+		return nil, err
+	}
+	response.Frames = append(response.Frames, frames...)
+	return response, nil
+}
+
+// queryConvertedTables runs pxlScript and converts each of its tables, as they
+// are, with convert. It is used for frames such as traces or annotations,
+// which Grafana expects in a specific shape.
+func (qp PixieQueryProcessor) queryConvertedTables(
+	ctx context.Context,
+	pxlScript string,
+	query backend.DataQuery,
+	clusterID string,
+	convert func(*data.Frame) (*data.Frame, error),
+) (*backend.DataResponse, error) {
+	qp.frameOptions.Format = formatTable
+	response, err := qp.queryScript(ctx, pxlScript, query, clusterID)
+	if err != nil {
+		return nil, err
+	}
+	for idx, frame := range response.Frames {
+		converted, err := convert(frame)
 		if err != nil {
-			return nil, err
+			return nil, newQueryError(statusBadRequest, "unable to convert table: %v", err)
 		}
-		if numRows != 0 && tablePrinter.FormatGrafanaTimeFrame() && tsSchema.Type == data.TimeSeriesTypeLong {
-			wideFrame, err := data.LongToWide(tablePrinter.frame,
-				&data.FillMissing{Mode: data.FillModeNull})
+		response.Frames[idx] = converted
+	}
+	return response, nil
+}
+
+// tableFrames converts the tables received by tm to Grafana frames.
+func (qp PixieQueryProcessor) tableFrames(ctx context.Context, tm *PixieToGrafanaTableMux) (data.Frames, error) {
+	var frames data.Frames
+	for _, tablePrinter := range tm.pxTablePrinterLst {
+		if qp.tableFormat(tablePrinter) == formatLogs {
+			logFrames, err := shapeLogs(tablePrinter.frame, qp.frameOptions)
 			if err != nil {
-				return nil, err
+				return nil, newQueryError(statusBadRequest, "unable to format frame as logs: %v", err)
 			}
-			response.Frames = append(response.Frames, wideFrame)
-		} else {
-			response.Frames = append(response.Frames,
-				tablePrinter.frame)
+			frames = append(frames, logFrames...)
+			continue
 		}
+		frame, err := qp.shapeFrame(ctx, tablePrinter)
+		if err != nil {
+			return nil, err
+		}
+		frames = append(frames, frame)
 	}
-	return response, nil
+	frames, err := nodeGraphFrames(frames, qp.frameOptions.nodeGraphOptions)
+	if err != nil {
+		return nil, newQueryError(statusBadRequest, "invalid node graph: %v", err)
+	}
+	return frames, nil
 }
 
-// queryClusters sends a request to Pixie, and returns a DataResponse with healthy clusters
-func (qp PixieQueryProcessor) queryClusters(ctx context.Context) (*backend.DataResponse, error) {
-	response := &backend.DataResponse{}
-	viziers, err := qp.client.ListViziers(ctx)
+// tableFormat returns the format of the frames of a table.
+func (qp PixieQueryProcessor) tableFormat(tablePrinter *PixieToGrafanaTablePrinter) frameFormat {
+	switch {
+	case qp.frameOptions.isNodeGraphFrame(tablePrinter.frame):
+		// Node graphs are made of the tables as they are.
+		return formatTable
+	case qp.alerting:
+		// Alert conditions need wide time series, whatever the time column is named,
+		// or numeric tables.
+		if tablePrinter.timeColIdx != -1 {
+			return formatTimeSeriesWide
+		}
+		return formatTable
+	}
+	return qp.frameOptions.Format
+}
 
+// shapeFrame returns the frame of a table in the format of the query.
+func (qp PixieQueryProcessor) shapeFrame(ctx context.Context, tablePrinter *PixieToGrafanaTablePrinter) (*data.Frame, error) {
+	frame := tablePrinter.frame
+	numRows, err := frame.RowLen()
 	if err != nil {
-		return nil, fmt.Errorf("Error with getting viziers: %s", err)
+		return nil, newQueryError(statusInternal, "invalid frame %q: %v", frame.Name, err)
 	}
 
+	format := qp.tableFormat(tablePrinter)
+	switch format {
+	case formatTable:
+		return frame, nil
+	case formatTimeSeriesLong, formatTimeSeriesWide:
+		// Scripts may display tables which aren't time series next to those
+		// which are, so those tables are kept as-is.
+		if !hasTimeField(frame) {
+			return frame, nil
+		}
+		frame, err = shapeTimeSeries(frame, qp.frameOptions)
+		if err != nil {
+			return nil, newQueryError(statusBadRequest, "unable to format frame as time series: %v", err)
+		}
+		if frame.Meta == nil {
+			frame.Meta = &data.FrameMeta{}
+		}
+		if format == formatTimeSeriesLong {
+			frame.Meta.Type = data.FrameTypeTimeSeriesLong
+			return frame, nil
+		}
+		if numRows == 0 || frame.TimeSeriesSchema().Type != data.TimeSeriesTypeLong {
+			frame.Meta.Type = data.FrameTypeTimeSeriesWide
+			return frame, nil
+		}
+	default:
+		// If time series schema long && time_ column && table not empty, convert to wide. Otherwise
+		// proceed as normal.
+		if numRows == 0 || !tablePrinter.FormatGrafanaTimeFrame() || frame.TimeSeriesSchema().Type != data.TimeSeriesTypeLong {
+			return frame, nil
+		}
+	}
+
+	_, span := tracer.Start(ctx, "LongToWide", trace.WithAttributes(attribute.String("table", frame.Name)))
+	wideFrame, err := data.LongToWide(frame, qp.frameOptions.fillMissing())
+	endSpan(span, err)
+	if err != nil {
+		return nil, newQueryError(statusInternal, "unable to convert frame %q to wide format: %v", frame.Name, err)
+	}
+	copyFieldConfigs(frame, wideFrame)
+	return wideFrame, nil
+}
+
+// queryClusters sends a request to Pixie, and returns a DataResponse with the
+// connected clusters, or every cluster if includeDisconnected is set.
+func (qp PixieQueryProcessor) queryClusters(ctx context.Context, includeDisconnected bool) (*backend.DataResponse, error) {
+	response := &backend.DataResponse{}
+	client, err := qp.instance.getClient(ctx)
+	if err != nil {
+		return nil, newQueryError(statusUnavailable, "error creating Pixie Client: %v", err)
+	}
+	start := time.Now()
+	viziers, err := client.ListViziers(ctx)
+	listClustersDuration.Observe(time.Since(start).Seconds())
+	if err != nil {
+		return nil, newQueryError(statusUnavailable, "Error with getting viziers: %s", err)
+	}
+
+	response.Frames = append(response.Frames, clustersFrame(viziers, includeDisconnected))
+
+	return response, nil
+}
+
+// clustersFrame returns the frame of the clusters of get-clusters queries.
+// pxapi.VizierInfo doesn't hold the last heartbeat of clusters, so the frame
+// can't list it.
+func clustersFrame(viziers []*pxapi.VizierInfo, includeDisconnected bool) *data.Frame {
 	vizierIds := make([]string, 0)
 	vizierNames := make([]string, 0)
+	vizierStatuses := make([]string, 0)
+	vizierVersions := make([]string, 0)
+	vizierDirectAccess := make([]bool, 0)
 
 	for _, vizier := range viziers {
-		// Only show connected clusters
-		if vizier.Status != pxapi.VizierStatusDisconnected {
-			vizierIds = append(vizierIds, vizier.ID)
-			vizierNames = append(vizierNames, vizier.Name)
+		if vizier.Status == pxapi.VizierStatusDisconnected && !includeDisconnected {
+			continue
 		}
+		vizierIds = append(vizierIds, vizier.ID)
+		vizierNames = append(vizierNames, vizier.Name)
+		vizierStatuses = append(vizierStatuses, string(vizier.Status))
+		vizierVersions = append(vizierVersions, vizier.Version)
+		vizierDirectAccess = append(vizierDirectAccess, vizier.DirectAccess)
 	}
 
-	vizierFrame := data.NewFrame(
+	return data.NewFrame(
 		"Vizier Clusters",
 		data.NewField("id", data.Labels{}, vizierIds),
 		data.NewField("name", data.Labels{}, vizierNames),
+		data.NewField("status", data.Labels{}, vizierStatuses),
+		data.NewField("version", data.Labels{}, vizierVersions),
+		data.NewField("direct_access", data.Labels{}, vizierDirectAccess),
 	)
-
-	response.Frames = append(response.Frames, vizierFrame)
-
-	return response, nil
 }
@@ -0,0 +1,213 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/resource"
+)
+
+const (
+	// scriptsResourcePath is the resource path listing the PxL script library.
+	scriptsResourcePath = "scripts"
+	// bundledScriptsDir is the directory of the scripts shipped with the plugin,
+	// relative to the plugin executable.
+	bundledScriptsDir = "pxl_scripts"
+	// examplesDir is the directory of the example scripts in the bundled scripts
+	// directory, where the frontend build copies the examples of the repository.
+	examplesDir = "examples"
+	// customScriptsDirEnv is set by Grafana to the scripts_dir setting of the
+	// plugin's section in its configuration, the directory of custom scripts.
+	// Only Grafana's administrators can set it, unlike the datasource settings.
+	customScriptsDirEnv = "GF_PLUGIN_SCRIPTS_DIR"
+)
+
+// scriptSource tells where a script of the library was loaded from.
+type scriptSource string
+
+const (
+	// sourceBundled is a script shipped with the plugin.
+	sourceBundled scriptSource = "bundled"
+	// sourceExample is an example script shipped with the plugin.
+	sourceExample scriptSource = "example"
+	// sourceCustom is a script from the custom scripts directory of the server.
+	sourceCustom scriptSource = "custom"
+)
+
+// pxlScript is a script of the PxL script library. Bundled scripts and .json
+// custom scripts use the same format as the frontend's Script.
+type pxlScript struct {
+	ID          string       `json:"id"`
+	Name        string       `json:"name"`
+	Description string       `json:"description"`
+	Source      scriptSource `json:"source"`
+	// Version changes whenever the script's content changes.
+	Version        string   `json:"version"`
+	Script         string   `json:"script,omitempty"`
+	ColumnNames    []string `json:"columnNames,omitempty"`
+	IsColDisplay   bool     `json:"isColDisplay,omitempty"`
+	IsGroupBy      bool     `json:"isGroupBy,omitempty"`
+	GroupByColumns []string `json:"groupByColumns,omitempty"`
+}
+
+// loadScript reads a .json or .pxl script file. A .pxl file holds the bare
+// script, which is named after the file.
+func loadScript(path string, source scriptSource) (*pxlScript, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	base := filepath.Base(path)
+	ext := filepath.Ext(base)
+	id := strings.TrimSuffix(base, ext)
+	script := &pxlScript{}
+	switch ext {
+	case ".json":
+		if err := json.Unmarshal(content, script); err != nil {
+			return nil, fmt.Errorf("error unmarshalling JSON: %v", err)
+		}
+	case ".pxl":
+		script.Name = id
+		script.Script = string(content)
+	default:
+		return nil, fmt.Errorf("unsupported script file extension %q", ext)
+	}
+	if script.Script == "" {
+		return nil, fmt.Errorf("script is empty")
+	}
+
+	sum := sha256.Sum256(content)
+	script.ID = fmt.Sprintf("%s/%s", source, id)
+	script.Source = source
+	script.Version = hex.EncodeToString(sum[:6])
+	return script, nil
+}
+
+// loadScriptDir reads every script file in dir. Files that can't be read are
+// logged and skipped so that a single broken script doesn't hide the others.
+func loadScriptDir(dir string, source scriptSource) []*pxlScript {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.DefaultLogger.Warn(fmt.Sprintf("Unable to read %s scripts directory %q: %v", source, dir, err))
+		return nil
+	}
+
+	var scripts []*pxlScript
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if entry.IsDir() || (ext != ".json" && ext != ".pxl") {
+			continue
+		}
+		script, err := loadScript(filepath.Join(dir, entry.Name()), source)
+		if err != nil {
+			log.DefaultLogger.Warn(fmt.Sprintf("Skipping script %q: %v", entry.Name(), err))
+			continue
+		}
+		scripts = append(scripts, script)
+	}
+	return scripts
+}
+
+// customScriptsPath returns the directory of custom scripts configured for
+// the server, or "" if there is none or it isn't an absolute path.
+func customScriptsPath() string {
+	dir := strings.TrimSpace(os.Getenv(customScriptsDirEnv))
+	if dir != "" && !filepath.IsAbs(dir) {
+		log.DefaultLogger.Warn(fmt.Sprintf("Ignoring the custom scripts directory %q, which isn't an absolute path", dir))
+		return ""
+	}
+	return dir
+}
+
+// sortScripts sorts scripts by name.
+func sortScripts(scripts []*pxlScript) []*pxlScript {
+	sort.Slice(scripts, func(i, j int) bool { return scripts[i].Name < scripts[j].Name })
+	return scripts
+}
+
+// loadScriptLibrary returns the bundled scripts followed by the example and
+// the custom scripts, each group sorted by name. The directories are read on
+// every call so that scripts added by admins show up without a restart.
+func (td *PixieDatasource) loadScriptLibrary() []*pxlScript {
+	scripts := sortScripts(loadScriptDir(td.bundledScriptsDir, sourceBundled))
+	scripts = append(scripts, sortScripts(loadScriptDir(filepath.Join(td.bundledScriptsDir, examplesDir), sourceExample))...)
+	if td.customScriptsDir == "" {
+		return scripts
+	}
+	return append(scripts, sortScripts(loadScriptDir(td.customScriptsDir, sourceCustom))...)
+}
+
+// CallResource implements Grafana's resource API. It serves the PxL script
+// library:
+//   - scripts lists the scripts without their body.
+//   - scripts/<source>/<name> returns a single script.
+func (td *PixieDatasource) CallResource(ctx context.Context, req *backend.CallResourceRequest, sender backend.CallResourceResponseSender) error {
+	if req.Method != http.MethodGet {
+		return sendResourceError(sender, http.StatusMethodNotAllowed, "method %s not allowed", req.Method)
+	}
+
+	path := strings.Trim(req.Path, "/")
+	switch {
+	case path == scriptsResourcePath:
+		scripts := td.loadScriptLibrary()
+		for _, script := range scripts {
+			script.Script = ""
+		}
+		if scripts == nil {
+			scripts = []*pxlScript{}
+		}
+		return resource.SendJSON(sender, scripts)
+	case strings.HasPrefix(path, scriptsResourcePath+"/"):
+		id := strings.TrimPrefix(path, scriptsResourcePath+"/")
+		for _, script := range td.loadScriptLibrary() {
+			if script.ID == id {
+				return resource.SendJSON(sender, script)
+			}
+		}
+		return sendResourceError(sender, http.StatusNotFound, "script %q not found", id)
+	default:
+		return sendResourceError(sender, http.StatusNotFound, "unknown resource %q", req.Path)
+	}
+}
+
+// sendResourceError sends a JSON error message with the given HTTP status.
+func sendResourceError(sender backend.CallResourceResponseSender, status int, format string, a ...interface{}) error {
+	body, err := json.Marshal(map[string]string{"error": fmt.Sprintf(format, a...)})
+	if err != nil {
+		return err
+	}
+	return sender.Send(&backend.CallResourceResponse{
+		Status:  status,
+		Headers: map[string][]string{"Content-Type": {"application/json"}},
+		Body:    body,
+	})
+}
@@ -0,0 +1,126 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeResourceSender struct {
+	response *backend.CallResourceResponse
+}
+
+func (s *fakeResourceSender) Send(resp *backend.CallResourceResponse) error {
+	s.response = resp
+	return nil
+}
+
+func writeScriptFile(t *testing.T, dir string, name string, content string) {
+	assert.Nil(t, os.WriteFile(filepath.Join(dir, name), []byte(content), 0644))
+}
+
+func callScriptsResource(t *testing.T, ds *PixieDatasource, path string) *backend.CallResourceResponse {
+	sender := &fakeResourceSender{}
+	err := ds.CallResource(context.Background(), &backend.CallResourceRequest{
+		PluginContext: backend.PluginContext{
+			DataSourceInstanceSettings: &backend.DataSourceInstanceSettings{ID: 1},
+		},
+		Path:   path,
+		Method: http.MethodGet,
+	}, sender)
+	assert.Nil(t, err)
+	return sender.response
+}
+
+func TestScriptsResource(t *testing.T) {
+	bundledDir := t.TempDir()
+	customDir := t.TempDir()
+	writeScriptFile(t, bundledDir, "pods.json", `{"name": "Pods", "description": "Pod metrics", "script": "import px"}`)
+	writeScriptFile(t, bundledDir, "README.md", "not a script")
+	assert.Nil(t, os.Mkdir(filepath.Join(bundledDir, examplesDir), 0755))
+	writeScriptFile(t, filepath.Join(bundledDir, examplesDir), "pods.pxl", "import px")
+	writeScriptFile(t, customDir, "http-errors.pxl", "import px\npx.display(df)")
+	writeScriptFile(t, customDir, "broken.json", `{"name": `)
+
+	ds := &PixieDatasource{
+		bundledScriptsDir: bundledDir,
+		customScriptsDir:  customDir,
+	}
+
+	resp := callScriptsResource(t, ds, "scripts")
+	assert.Equal(t, http.StatusOK, resp.Status)
+	var scripts []pxlScript
+	assert.Nil(t, json.Unmarshal(resp.Body, &scripts))
+	assert.Equal(t, 3, len(scripts))
+	assert.Equal(t, "bundled/pods", scripts[0].ID)
+	assert.Equal(t, "Pods", scripts[0].Name)
+	assert.Equal(t, "", scripts[0].Script)
+	assert.Equal(t, "example/pods", scripts[1].ID)
+	assert.Equal(t, sourceExample, scripts[1].Source)
+	assert.Equal(t, "custom/http-errors", scripts[2].ID)
+	assert.Equal(t, sourceCustom, scripts[2].Source)
+	assert.NotEqual(t, "", scripts[2].Version)
+
+	resp = callScriptsResource(t, ds, "scripts/custom/http-errors")
+	assert.Equal(t, http.StatusOK, resp.Status)
+	var script pxlScript
+	assert.Nil(t, json.Unmarshal(resp.Body, &script))
+	assert.Equal(t, "import px\npx.display(df)", script.Script)
+	assert.Equal(t, scripts[2].Version, script.Version)
+
+	resp = callScriptsResource(t, ds, "scripts/custom/broken")
+	assert.Equal(t, http.StatusNotFound, resp.Status)
+}
+
+func TestExampleScriptsLoad(t *testing.T) {
+	// The frontend build copies the examples of the repository to the bundled
+	// scripts, so each of them must load.
+	paths, err := filepath.Glob(filepath.Join("..", "examples", "*.pxl"))
+	assert.Nil(t, err)
+	assert.NotEqual(t, 0, len(paths))
+	assert.Equal(t, len(paths), len(loadScriptDir(filepath.Join("..", "examples"), sourceExample)))
+}
+
+func TestScriptVersionChangesWithContent(t *testing.T) {
+	dir := t.TempDir()
+	writeScriptFile(t, dir, "script.pxl", "import px")
+	before, err := loadScript(filepath.Join(dir, "script.pxl"), sourceCustom)
+	assert.Nil(t, err)
+
+	writeScriptFile(t, dir, "script.pxl", "import px\npx.display(df)")
+	after, err := loadScript(filepath.Join(dir, "script.pxl"), sourceCustom)
+	assert.Nil(t, err)
+	assert.NotEqual(t, before.Version, after.Version)
+}
+
+func TestCustomScriptsPath(t *testing.T) {
+	t.Setenv(customScriptsDirEnv, " /var/lib/grafana/pxl_scripts ")
+	assert.Equal(t, "/var/lib/grafana/pxl_scripts", customScriptsPath())
+
+	t.Setenv(customScriptsDirEnv, "pxl_scripts")
+	assert.Equal(t, "", customScriptsPath())
+}
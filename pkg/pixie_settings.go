@@ -0,0 +1,160 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+)
+
+const (
+	// Define keys to retrieve configs passed from UI.
+	apiKeyField    = "apiKey"
+	clusterIDField = "clusterId"
+)
+
+const (
+	// defaultMaxConcurrentQueries is used when maxConcurrentQueries is not configured.
+	defaultMaxConcurrentQueries = 10
+	// defaultQueryTimeoutSeconds is used when queryTimeout is not configured.
+	defaultQueryTimeoutSeconds = 60
+	// defaultMaxRowsPerTable is used when maxRowsPerTable is not configured.
+	defaultMaxRowsPerTable = 100000
+	// defaultMaxBytesPerTable is used when maxBytesPerTable is not configured.
+	defaultMaxBytesPerTable = 64 << 20
+	// defaultMaxRowsPerQuery is used when maxRowsPerQuery is not configured.
+	defaultMaxRowsPerQuery = 500000
+	// defaultMaxBytesPerQuery is used when maxBytesPerQuery is not configured.
+	defaultMaxBytesPerQuery = 256 << 20
+	// defaultCacheMaxBytes is used when cacheMaxBytes is not configured.
+	defaultCacheMaxBytes = 64 << 20
+)
+
+// pixieSettings is the configuration of a Pixie datasource.
+type pixieSettings struct {
+	// CloudAddr is the address of Pixie Cloud. Empty means the default cloud.
+	CloudAddr string `json:"cloudAddr"`
+	// MaxConcurrentQueries caps how many queries of a single request run at once.
+	MaxConcurrentQueries int `json:"maxConcurrentQueries"`
+	// QueryTimeout is the default time in seconds a PxL script may run.
+	QueryTimeout int `json:"queryTimeout"`
+	// MaxRowsPerTable is the number of rows of a table after which its rows are dropped.
+	MaxRowsPerTable int `json:"maxRowsPerTable"`
+	// MaxBytesPerTable is the size of a table after which its rows are dropped.
+	MaxBytesPerTable int `json:"maxBytesPerTable"`
+	// MaxRowsPerQuery is the number of rows of a query after which its script is stopped.
+	MaxRowsPerQuery int `json:"maxRowsPerQuery"`
+	// MaxBytesPerQuery is the size of a query's results after which its script is stopped.
+	MaxBytesPerQuery int `json:"maxBytesPerQuery"`
+	// CacheTTL is the time in seconds script responses are cached. Zero disables the cache.
+	CacheTTL int `json:"cacheTTL"`
+	// CacheMaxBytes is the size of the cached responses after which the least recently used are dropped.
+	CacheMaxBytes int `json:"cacheMaxBytes"`
+
+	// APIKey is the Pixie API key, read from the secure settings.
+	APIKey string `json:"-"`
+	// ClusterID is the default cluster, read from the secure settings.
+	ClusterID string `json:"-"`
+}
+
+// loadSettings parses the datasource settings and fills in defaults.
+func loadSettings(instanceSettings backend.DataSourceInstanceSettings) (*pixieSettings, error) {
+	settings := &pixieSettings{}
+	if len(instanceSettings.JSONData) != 0 {
+		if err := json.Unmarshal(instanceSettings.JSONData, settings); err != nil {
+			return nil, fmt.Errorf("error unmarshalling JSON: %v", err)
+		}
+	}
+
+	// untrimmed apiKey and clusterID strings will cause an error when creating clients
+	settings.CloudAddr = strings.TrimSpace(settings.CloudAddr)
+	settings.APIKey = strings.TrimSpace(instanceSettings.DecryptedSecureJSONData[apiKeyField])
+	settings.ClusterID = strings.TrimSpace(instanceSettings.DecryptedSecureJSONData[clusterIDField])
+
+	if settings.MaxConcurrentQueries == 0 {
+		settings.MaxConcurrentQueries = defaultMaxConcurrentQueries
+	}
+	if settings.QueryTimeout == 0 {
+		settings.QueryTimeout = defaultQueryTimeoutSeconds
+	}
+	if settings.MaxRowsPerTable == 0 {
+		settings.MaxRowsPerTable = defaultMaxRowsPerTable
+	}
+	if settings.MaxBytesPerTable == 0 {
+		settings.MaxBytesPerTable = defaultMaxBytesPerTable
+	}
+	if settings.MaxRowsPerQuery == 0 {
+		settings.MaxRowsPerQuery = defaultMaxRowsPerQuery
+	}
+	if settings.MaxBytesPerQuery == 0 {
+		settings.MaxBytesPerQuery = defaultMaxBytesPerQuery
+	}
+	if settings.CacheMaxBytes == 0 {
+		settings.CacheMaxBytes = defaultCacheMaxBytes
+	}
+	return settings, nil
+}
+
+// validate checks that the settings can be used to connect to Pixie.
+func (s *pixieSettings) validate() error {
+	if s.APIKey == "" {
+		return fmt.Errorf("Pixie API key is not configured")
+	}
+	if strings.Contains(s.CloudAddr, "://") {
+		return fmt.Errorf("cloudAddr %q must be a host:port address without a scheme", s.CloudAddr)
+	}
+	if s.MaxConcurrentQueries < 1 {
+		return fmt.Errorf("maxConcurrentQueries must be at least 1, got %d", s.MaxConcurrentQueries)
+	}
+	if s.QueryTimeout < 1 {
+		return fmt.Errorf("queryTimeout must be at least 1 second, got %d", s.QueryTimeout)
+	}
+	limits := []struct {
+		name  string
+		value int
+	}{
+		{"maxRowsPerTable", s.MaxRowsPerTable},
+		{"maxBytesPerTable", s.MaxBytesPerTable},
+		{"maxRowsPerQuery", s.MaxRowsPerQuery},
+		{"maxBytesPerQuery", s.MaxBytesPerQuery},
+		{"cacheMaxBytes", s.CacheMaxBytes},
+	}
+	for _, limit := range limits {
+		if limit.value < 1 {
+			return fmt.Errorf("%s must be at least 1, got %d", limit.name, limit.value)
+		}
+	}
+	if s.CacheTTL < 0 {
+		return fmt.Errorf("cacheTTL must not be negative, got %d", s.CacheTTL)
+	}
+	return nil
+}
+
+// resultLimits returns the limits of the results of a query.
+func (s *pixieSettings) resultLimits() resultLimits {
+	return resultLimits{
+		maxRowsPerTable:  s.MaxRowsPerTable,
+		maxBytesPerTable: s.MaxBytesPerTable,
+		maxRowsPerQuery:  s.MaxRowsPerQuery,
+		maxBytesPerQuery: s.MaxBytesPerQuery,
+	}
+}
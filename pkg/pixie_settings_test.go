@@ -0,0 +1,81 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"testing"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadSettings(t *testing.T) {
+	settings, err := loadSettings(backend.DataSourceInstanceSettings{
+		JSONData: []byte(`{"cloudAddr": " withpixie.ai:443 "}`),
+		DecryptedSecureJSONData: map[string]string{
+			apiKeyField:    " px-api-key\n",
+			clusterIDField: " cluster-id ",
+		},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "withpixie.ai:443", settings.CloudAddr)
+	assert.Equal(t, "px-api-key", settings.APIKey)
+	assert.Equal(t, "cluster-id", settings.ClusterID)
+	assert.Equal(t, defaultMaxConcurrentQueries, settings.MaxConcurrentQueries)
+	assert.Equal(t, defaultQueryTimeoutSeconds, settings.QueryTimeout)
+	assert.Equal(t, defaultMaxRowsPerTable, settings.MaxRowsPerTable)
+	assert.Equal(t, defaultMaxBytesPerQuery, settings.MaxBytesPerQuery)
+	assert.Equal(t, 0, settings.CacheTTL)
+	assert.Equal(t, defaultCacheMaxBytes, settings.CacheMaxBytes)
+	assert.Nil(t, settings.validate())
+}
+
+func TestLoadSettingsMissingCloudAddr(t *testing.T) {
+	settings, err := loadSettings(backend.DataSourceInstanceSettings{
+		DecryptedSecureJSONData: map[string]string{apiKeyField: "px-api-key"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "", settings.CloudAddr)
+	assert.Nil(t, settings.validate())
+}
+
+func TestSettingsValidate(t *testing.T) {
+	tests := []struct {
+		name     string
+		jsonData string
+		apiKey   string
+	}{
+		{name: "missing API key", jsonData: `{}`, apiKey: " "},
+		{name: "cloudAddr with scheme", jsonData: `{"cloudAddr": "https://withpixie.ai"}`, apiKey: "key"},
+		{name: "negative concurrency", jsonData: `{"maxConcurrentQueries": -1}`, apiKey: "key"},
+		{name: "negative timeout", jsonData: `{"queryTimeout": -5}`, apiKey: "key"},
+		{name: "negative row limit", jsonData: `{"maxRowsPerQuery": -1}`, apiKey: "key"},
+		{name: "negative cache TTL", jsonData: `{"cacheTTL": -10}`, apiKey: "key"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			settings, err := loadSettings(backend.DataSourceInstanceSettings{
+				JSONData:                []byte(test.jsonData),
+				DecryptedSecureJSONData: map[string]string{apiKeyField: test.apiKey},
+			})
+			assert.Nil(t, err)
+			assert.NotNil(t, settings.validate())
+		})
+	}
+}
@@ -0,0 +1,273 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/backend/log"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/grafana/grafana-plugin-sdk-go/live"
+)
+
+const (
+	// streamPathPrefix prefixes the Grafana Live channel path of every PxL script stream.
+	streamPathPrefix = "script/"
+	// defaultStreamInterval is the time between two executions of a streamed script.
+	defaultStreamInterval = 5 * time.Second
+	// minStreamInterval is the smallest accepted time between two executions.
+	minStreamInterval = time.Second
+)
+
+// streamQuery describes a PxL script whose results are pushed to a Grafana Live channel.
+type streamQuery struct {
+	PxlScript string `json:"pxlScript"`
+	ClusterID string `json:"clusterID"`
+	// Interval is the time in seconds between two executions of the script.
+	Interval int `json:"interval"`
+	// Window is the length in seconds of the time range the script runs over.
+	Window int `json:"window"`
+	// Timeout overrides the datasource's query timeout, in seconds.
+	Timeout int `json:"timeout"`
+	// ExpandUPIDs adds the agent ID, PID and start time of UPID columns as fields.
+	ExpandUPIDs bool `json:"expandUPIDs"`
+	// Table is the table of the script whose frames are pushed. A channel
+	// carries frames of a single schema, so only one table is streamed.
+	Table string `json:"table"`
+	frameOptions
+
+	// start is the end of the time range of the query which registered the
+	// stream, whose results the panel already has. It isn't part of the path.
+	start time.Time
+}
+
+// path returns the channel path of the stream, unique per datasource and query.
+func (sq streamQuery) path(datasourceUID string) (string, error) {
+	b, err := json.Marshal(sq)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(append([]byte(datasourceUID), b...))
+	return streamPathPrefix + hex.EncodeToString(sum[:16]), nil
+}
+
+// interval returns the time between two executions of the script.
+func (sq streamQuery) interval() time.Duration {
+	interval := time.Duration(sq.Interval) * time.Second
+	if interval == 0 {
+		return defaultStreamInterval
+	}
+	if interval < minStreamInterval {
+		return minStreamInterval
+	}
+	return interval
+}
+
+// queryStream runs pxlScript once for the initial frames and registers a
+// Grafana Live channel on which the script's later results are pushed.
+func (td *PixieDatasource) queryStream(ctx context.Context, qp PixieQueryProcessor, qm queryModel,
+	query backend.DataQuery, clusterID string) (*backend.DataResponse, error) {
+	sq := streamQuery{
+		PxlScript:    qm.QueryBody.PxlScript,
+		ClusterID:    clusterID,
+		Interval:     qm.StreamInterval,
+		Window:       int(query.TimeRange.Duration().Seconds()),
+		Timeout:      qm.Timeout,
+		ExpandUPIDs:  qm.ExpandUPIDs,
+		frameOptions: qm.frameOptions,
+	}
+	response, err := qp.queryScript(ctx, sq.PxlScript, query, clusterID)
+	if err != nil {
+		return nil, err
+	}
+	if response.Error != nil || len(response.Frames) == 0 {
+		return response, nil
+	}
+
+	sq.Table = response.Frames[0].Name
+	sq.start = query.TimeRange.To
+	path, err := sq.path(qp.instance.uid)
+	if err != nil {
+		return nil, newQueryError(statusInternal, "unable to create stream path: %v", err)
+	}
+	td.streams.Store(path, sq)
+
+	channel := live.Channel{
+		Scope:     live.ScopeDatasource,
+		Namespace: qp.instance.uid,
+		Path:      path,
+	}
+	for _, frame := range response.Frames {
+		if frame.Name != sq.Table {
+			frame.AppendNotices(data.Notice{
+				Severity: data.NoticeSeverityWarning,
+				Text:     fmt.Sprintf("Only table %s is streamed, this table isn't updated.", sq.Table),
+			})
+			continue
+		}
+		if frame.Meta == nil {
+			frame.Meta = &data.FrameMeta{}
+		}
+		frame.Meta.Channel = channel.String()
+	}
+	return response, nil
+}
+
+// streamErrorFrame returns a frame of table telling the subscribers of a
+// stream why it wasn't updated.
+func streamErrorFrame(table string, err error) *data.Frame {
+	frame := data.NewFrame(table)
+	frame.AppendNotices(data.Notice{Severity: data.NoticeSeverityError, Text: err.Error()})
+	return frame
+}
+
+// getStreamQuery returns the streamQuery for path, registered by queryStream or sent
+// by the subscriber.
+func (td *PixieDatasource) getStreamQuery(path string, reqData json.RawMessage) (streamQuery, bool) {
+	if !strings.HasPrefix(path, streamPathPrefix) {
+		return streamQuery{}, false
+	}
+	if sq, ok := td.streams.Load(path); ok {
+		return sq.(streamQuery), true
+	}
+	if len(reqData) == 0 {
+		return streamQuery{}, false
+	}
+	var sq streamQuery
+	if err := json.Unmarshal(reqData, &sq); err != nil || sq.PxlScript == "" {
+		return streamQuery{}, false
+	}
+	return sq, true
+}
+
+// SubscribeStream implements Grafana's StreamHandler API. Subscriptions are
+// allowed to channels of known PxL script streams.
+func (td *PixieDatasource) SubscribeStream(ctx context.Context, req *backend.SubscribeStreamRequest) (*backend.SubscribeStreamResponse, error) {
+	if _, ok := td.getStreamQuery(req.Path, req.Data); !ok {
+		return &backend.SubscribeStreamResponse{
+			Status: backend.SubscribeStreamStatusNotFound,
+		}, nil
+	}
+	return &backend.SubscribeStreamResponse{
+		Status: backend.SubscribeStreamStatusOK,
+	}, nil
+}
+
+// PublishStream implements Grafana's StreamHandler API. Clients can't publish
+// to PxL script streams.
+func (td *PixieDatasource) PublishStream(ctx context.Context, req *backend.PublishStreamRequest) (*backend.PublishStreamResponse, error) {
+	return &backend.PublishStreamResponse{
+		Status: backend.PublishStreamStatusPermissionDenied,
+	}, nil
+}
+
+// RunStream implements Grafana's StreamHandler API. It executes the stream's
+// PxL script on every interval and pushes the resulting frames of its table
+// until Grafana cancels ctx. Grafana appends the pushed rows to the panel, so
+// each execution only covers the time since the previous one, starting from
+// the end of the registering query, or a window before the first execution.
+// Failed executions push a frame with an error notice and are retried over
+// the same time range.
+func (td *PixieDatasource) RunStream(ctx context.Context, req *backend.RunStreamRequest, sender *backend.StreamSender) error {
+	sq, ok := td.getStreamQuery(req.Path, req.Data)
+	if !ok {
+		return fmt.Errorf("unknown stream: %s", req.Path)
+	}
+	// Grafana runs a single RunStream per channel until its last subscriber
+	// leaves, after which the stream is registered again by its next query.
+	defer td.streams.Delete(req.Path)
+
+	instance, err := td.getInstance(req.PluginContext)
+	if err != nil {
+		return err
+	}
+
+	timeout := instance.settings.QueryTimeout
+	if sq.Timeout > 0 {
+		timeout = sq.Timeout
+	}
+	// Streams bypass the response cache since their time range moves on every interval.
+	qp := PixieQueryProcessor{
+		instance:     instance,
+		queryType:    RunScript,
+		timeout:      time.Duration(timeout) * time.Second,
+		expandUPIDs:  sq.ExpandUPIDs,
+		noCache:      true,
+		frameOptions: sq.frameOptions,
+	}
+
+	interval := sq.interval()
+	window := time.Duration(sq.Window) * time.Second
+	if window < interval {
+		window = interval
+	}
+
+	from := sq.start
+	if from.IsZero() {
+		from = time.Now().Add(-window)
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case now := <-ticker.C:
+			query := backend.DataQuery{
+				RefID:    req.Path,
+				Interval: interval,
+				TimeRange: backend.TimeRange{
+					From: from,
+					To:   now,
+				},
+			}
+			response, err := qp.queryScript(ctx, sq.PxlScript, query, sq.ClusterID)
+			if err == nil {
+				err = response.Error
+			}
+			if err != nil {
+				log.DefaultLogger.Error(fmt.Sprintf("Error running stream %s: %v", req.Path, err))
+				if err := sender.SendFrame(streamErrorFrame(sq.Table, err), data.IncludeAll); err != nil {
+					return err
+				}
+				continue
+			}
+			from = now
+			for _, frame := range response.Frames {
+				// Streams subscribed to without a query stream their first table.
+				if sq.Table == "" {
+					sq.Table = frame.Name
+				}
+				if frame.Name != sq.Table {
+					continue
+				}
+				if err := sender.SendFrame(frame, data.IncludeAll); err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
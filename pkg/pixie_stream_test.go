@@ -0,0 +1,220 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/grafana/grafana-plugin-sdk-go/backend"
+	"github.com/grafana/grafana-plugin-sdk-go/data"
+	"github.com/stretchr/testify/assert"
+
+	"px.dev/pxapi"
+	"px.dev/pxapi/proto/vizierpb"
+	"px.dev/pxapi/types"
+)
+
+func TestStreamQueryPath(t *testing.T) {
+	sq := streamQuery{PxlScript: "import px", ClusterID: "cluster"}
+	path, err := sq.path("uid-1")
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(path, streamPathPrefix))
+
+	samePath, _ := sq.path("uid-1")
+	otherDatasourcePath, _ := sq.path("uid-2")
+	assert.Equal(t, path, samePath)
+	assert.NotEqual(t, path, otherDatasourcePath)
+}
+
+func TestStreamQueryInterval(t *testing.T) {
+	assert.Equal(t, defaultStreamInterval, streamQuery{}.interval())
+	assert.Equal(t, 10*time.Second, streamQuery{Interval: 10}.interval())
+}
+
+func TestSubscribeStream(t *testing.T) {
+	ds := &PixieDatasource{}
+	sq := streamQuery{PxlScript: "import px", ClusterID: "cluster"}
+	path, _ := sq.path("uid")
+	ctx := context.Background()
+
+	resp, err := ds.SubscribeStream(ctx, &backend.SubscribeStreamRequest{Path: path})
+	assert.Nil(t, err)
+	assert.Equal(t, backend.SubscribeStreamStatusNotFound, resp.Status)
+
+	ds.streams.Store(path, sq)
+	resp, err = ds.SubscribeStream(ctx, &backend.SubscribeStreamRequest{Path: path})
+	assert.Nil(t, err)
+	assert.Equal(t, backend.SubscribeStreamStatusOK, resp.Status)
+
+	resp, err = ds.SubscribeStream(ctx, &backend.SubscribeStreamRequest{
+		Path: streamPathPrefix + "direct",
+		Data: []byte(`{"pxlScript": "import px", "clusterID": "cluster"}`),
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, backend.SubscribeStreamStatusOK, resp.Status)
+}
+
+func TestQueryStreamFirstTable(t *testing.T) {
+	cloud := &fakeCloudClient{newVizier: func(ctx context.Context, clusterID string) (vizierClient, error) {
+		return &fakeVizierClient{run: func(ctx context.Context, pxlScript string, mux pxapi.TableMuxer) error {
+			for _, name := range []string{"first", "second"} {
+				metadata := makeTableMetadata(vizierpb.STRING)
+				metadata.Name = name
+				value := types.NewStringValue(&metadata.ColInfo[0])
+				value.ScanString(name)
+				record := &types.Record{Data: []types.Datum{value}, TableMetadata: metadata}
+				if err := sendTable(ctx, mux, metadata, []*types.Record{record}); err != nil {
+					return err
+				}
+			}
+			return nil
+		}}, nil
+	}}
+	ds := newFakeDatasource(cloud)
+	req := makeQueryDataRequest(backend.DataQuery{
+		RefID: "A",
+		JSON:  []byte(`{"queryType": "run-script", "clusterID": "cluster-a", "streaming": true, "queryBody": {"pxlScript": "import px"}}`),
+	})
+
+	resp, err := ds.QueryData(context.Background(), req)
+	assert.Nil(t, err)
+	assert.Nil(t, resp.Responses["A"].Error)
+	frames := resp.Responses["A"].Frames
+	assert.Equal(t, 2, len(frames))
+	// Only the first table is streamed, the other tables are told they aren't updated.
+	assert.NotEqual(t, "", frames[0].Meta.Channel)
+	assert.Equal(t, "", frames[1].Meta.Channel)
+	assert.Equal(t, data.NoticeSeverityWarning, frames[1].Meta.Notices[0].Severity)
+
+	var sq streamQuery
+	ds.streams.Range(func(key, value interface{}) bool {
+		sq = value.(streamQuery)
+		return false
+	})
+	assert.Equal(t, "first", sq.Table)
+}
+
+// packetSender records the packets sent to a stream, canceling the stream after limit packets.
+type packetSender struct {
+	cancel  context.CancelFunc
+	limit   int
+	packets []*backend.StreamPacket
+}
+
+func (s *packetSender) Send(packet *backend.StreamPacket) error {
+	s.packets = append(s.packets, packet)
+	if len(s.packets) >= s.limit {
+		s.cancel()
+	}
+	return nil
+}
+
+func TestRunStreamError(t *testing.T) {
+	cloud := &fakeCloudClient{newVizier: func(ctx context.Context, clusterID string) (vizierClient, error) {
+		return &fakeVizierClient{run: func(context.Context, string, pxapi.TableMuxer) error {
+			return errors.New("compilation failed")
+		}}, nil
+	}}
+	ds := newFakeDatasource(cloud)
+	sq := streamQuery{PxlScript: "import px", ClusterID: "cluster-a", Interval: 1, Table: "first"}
+	path, _ := sq.path("")
+	ds.streams.Store(path, sq)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sender := &packetSender{cancel: cancel, limit: 1}
+	err := ds.RunStream(ctx, &backend.RunStreamRequest{
+		PluginContext: makeQueryDataRequest().PluginContext,
+		Path:          path,
+	}, backend.NewStreamSender(sender))
+	assert.Nil(t, err)
+
+	// The failure is pushed to the subscribers as a notice.
+	assert.Equal(t, 1, len(sender.packets))
+	var frame data.Frame
+	assert.Nil(t, frame.UnmarshalJSON(sender.packets[0].Data))
+	assert.Equal(t, "first", frame.Name)
+	assert.Equal(t, data.NoticeSeverityError, frame.Meta.Notices[0].Severity)
+	assert.Contains(t, frame.Meta.Notices[0].Text, "compilation failed")
+
+	// The stream is unregistered once it stops.
+	_, ok := ds.streams.Load(path)
+	assert.False(t, ok)
+}
+
+func TestRunStreamPushesNewRows(t *testing.T) {
+	var ranges []backend.TimeRange
+	cloud := &fakeCloudClient{newVizier: func(ctx context.Context, clusterID string) (vizierClient, error) {
+		return &fakeVizierClient{run: func(ctx context.Context, pxlScript string, mux pxapi.TableMuxer) error {
+			// The script is "$__from,$__to", and returns a row per second of its time range.
+			var from, to int64
+			if _, err := fmt.Sscanf(pxlScript, "%d,%d", &from, &to); err != nil {
+				return err
+			}
+			ranges = append(ranges, backend.TimeRange{From: time.Unix(0, from), To: time.Unix(0, to)})
+			metadata := makeTableMetadata(vizierpb.TIME64NS, vizierpb.FLOAT64)
+			metadata.Name = "first"
+			var records []*types.Record
+			for ts := (from + int64(time.Second) - 1) / int64(time.Second) * int64(time.Second); ts < to; ts += int64(time.Second) {
+				timeVal := types.NewTime64NSValue(&metadata.ColInfo[0])
+				timeVal.ScanInt64(ts)
+				value := types.NewFloat64Value(&metadata.ColInfo[1])
+				value.ScanFloat64(1)
+				records = append(records, &types.Record{Data: []types.Datum{timeVal, value}, TableMetadata: metadata})
+			}
+			return sendTable(ctx, mux, metadata, records)
+		}}, nil
+	}}
+	ds := newFakeDatasource(cloud)
+	sq := streamQuery{PxlScript: "$__from,$__to", ClusterID: "cluster-a", Interval: 1, Table: "first", start: time.Now().Add(-3 * time.Second)}
+	path, _ := sq.path("")
+	ds.streams.Store(path, sq)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sender := &packetSender{cancel: cancel, limit: 2}
+	err := ds.RunStream(ctx, &backend.RunStreamRequest{
+		PluginContext: makeQueryDataRequest().PluginContext,
+		Path:          path,
+	}, backend.NewStreamSender(sender))
+	assert.Nil(t, err)
+
+	// Each execution starts where the previous one ended, the first at the end of the registering query.
+	assert.Equal(t, 2, len(ranges))
+	assert.True(t, ranges[0].From.Equal(sq.start))
+	assert.True(t, ranges[1].From.Equal(ranges[0].To))
+
+	// So the rows pushed by the second execution aren't duplicates.
+	seen := make(map[time.Time]bool)
+	for _, packet := range sender.packets {
+		var frame data.Frame
+		assert.Nil(t, frame.UnmarshalJSON(packet.Data))
+		for i := 0; i < frame.Rows(); i++ {
+			ts := frame.Fields[0].At(i).(time.Time)
+			assert.False(t, seen[ts], "row %v pushed twice", ts)
+			seen[ts] = true
+		}
+	}
+	assert.GreaterOrEqual(t, len(seen), 4)
+}
@@ -0,0 +1,46 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc/metadata"
+)
+
+func TestRequestContext(t *testing.T) {
+	t.Setenv(otlpAddressEnv, "")
+	shutdown, err := setupTracing(context.Background())
+	assert.Nil(t, err)
+	defer shutdown(context.Background())
+
+	md := metadata.Pairs("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	ctx := requestContext(metadata.NewIncomingContext(context.Background(), md))
+	spanContext := trace.SpanContextFromContext(ctx)
+	assert.True(t, spanContext.IsRemote())
+	assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", spanContext.TraceID().String())
+	assert.Equal(t, "00f067aa0ba902b7", spanContext.SpanID().String())
+
+	// Requests without a trace context start new traces.
+	ctx = requestContext(context.Background())
+	assert.False(t, trace.SpanContextFromContext(ctx).IsValid())
+}
@@ -16,12 +16,13 @@
  * SPDX-License-Identifier: Apache-2.0
  */
 
-import React, { PureComponent } from 'react';
+import React, { ChangeEvent, PureComponent } from 'react';
 import { LegacyForms } from '@grafana/ui';
 import {
   DataSourcePluginOptionsEditorProps,
   onUpdateDatasourceJsonDataOption,
   onUpdateDatasourceSecureJsonDataOption,
+  updateDatasourcePluginJsonDataOption,
   updateDatasourcePluginResetOption,
 } from '@grafana/data';
 import { PixieDataSourceOptions, PixieSecureDataSourceOptions } from './types';
@@ -41,6 +42,12 @@ export class ConfigEditor extends PureComponent<Props, State> {
     updateDatasourcePluginResetOption(this.props, 'clusterId');
   };
 
+  // Stores a numeric jsonData option, clearing it when the input is not a number.
+  onUpdateNumberOption = (key: keyof PixieDataSourceOptions) => (event: ChangeEvent<HTMLInputElement>) => {
+    const value = parseInt(event.target.value, 10);
+    updateDatasourcePluginJsonDataOption(this.props, key, isNaN(value) ? undefined : value);
+  };
+
   render() {
     const { options } = this.props;
     const { secureJsonFields } = options;
@@ -91,6 +98,118 @@ export class ConfigEditor extends PureComponent<Props, State> {
             />
           </div>
         </div>
+
+        <div className="gf-form-inline">
+          <div className="gf-form">
+            <FormField
+              type="number"
+              value={jsonData.maxConcurrentQueries ?? ''}
+              label="Max concurrent queries"
+              placeholder="10"
+              labelWidth={20}
+              inputWidth={20}
+              onChange={this.onUpdateNumberOption('maxConcurrentQueries')}
+            />
+          </div>
+        </div>
+
+        <div className="gf-form-inline">
+          <div className="gf-form">
+            <FormField
+              type="number"
+              value={jsonData.queryTimeout ?? ''}
+              label="Query timeout (seconds)"
+              placeholder="60"
+              labelWidth={20}
+              inputWidth={20}
+              onChange={this.onUpdateNumberOption('queryTimeout')}
+            />
+          </div>
+        </div>
+
+        <div className="gf-form-inline">
+          <div className="gf-form">
+            <FormField
+              type="number"
+              value={jsonData.maxRowsPerTable ?? ''}
+              label="Max rows per table"
+              placeholder="100000"
+              labelWidth={20}
+              inputWidth={20}
+              onChange={this.onUpdateNumberOption('maxRowsPerTable')}
+            />
+          </div>
+        </div>
+
+        <div className="gf-form-inline">
+          <div className="gf-form">
+            <FormField
+              type="number"
+              value={jsonData.maxBytesPerTable ?? ''}
+              label="Max bytes per table"
+              placeholder="67108864"
+              labelWidth={20}
+              inputWidth={20}
+              onChange={this.onUpdateNumberOption('maxBytesPerTable')}
+            />
+          </div>
+        </div>
+
+        <div className="gf-form-inline">
+          <div className="gf-form">
+            <FormField
+              type="number"
+              value={jsonData.maxRowsPerQuery ?? ''}
+              label="Max rows per query"
+              placeholder="500000"
+              labelWidth={20}
+              inputWidth={20}
+              onChange={this.onUpdateNumberOption('maxRowsPerQuery')}
+            />
+          </div>
+        </div>
+
+        <div className="gf-form-inline">
+          <div className="gf-form">
+            <FormField
+              type="number"
+              value={jsonData.maxBytesPerQuery ?? ''}
+              label="Max bytes per query"
+              placeholder="268435456"
+              labelWidth={20}
+              inputWidth={20}
+              onChange={this.onUpdateNumberOption('maxBytesPerQuery')}
+            />
+          </div>
+        </div>
+
+        <div className="gf-form-inline">
+          <div className="gf-form">
+            <FormField
+              type="number"
+              value={jsonData.cacheTTL ?? ''}
+              label="Cache TTL (seconds)"
+              placeholder="0"
+              labelWidth={20}
+              inputWidth={20}
+              onChange={this.onUpdateNumberOption('cacheTTL')}
+            />
+          </div>
+        </div>
+
+        <div className="gf-form-inline">
+          <div className="gf-form">
+            <FormField
+              type="number"
+              value={jsonData.cacheMaxBytes ?? ''}
+              label="Cache max bytes"
+              placeholder="67108864"
+              labelWidth={20}
+              inputWidth={20}
+              onChange={this.onUpdateNumberOption('cacheMaxBytes')}
+            />
+          </div>
+        </div>
       </div>
     );
   }
@@ -16,7 +16,14 @@
  * SPDX-License-Identifier: Apache-2.0
  */
 
-import { DataFrame, DataSourceInstanceSettings, MetricFindValue, ScopedVars, toDataFrame } from '@grafana/data';
+import {
+  AnnotationQuery,
+  DataFrame,
+  DataSourceInstanceSettings,
+  MetricFindValue,
+  ScopedVars,
+  toDataFrame,
+} from '@grafana/data';
 import {
   DataSourceWithBackend,
   getTemplateSrv,
@@ -31,22 +38,23 @@ import {
   PixieVariableQuery,
   CLUSTER_VARIABLE_NAME as CLUSTER_VARIABLE_NAME,
   QueryType,
+  ScriptInfo,
 } from './types';
 import { getColumnsScript } from './column_display';
 import { getGroupByScript } from './groupby';
-import { checkExhaustive, getClusterId } from 'utils';
+import { checkExhaustive, getClusterId, getClusterIds } from 'utils';
 
-const timeVars = [
-  ['$__from', '__time_from'],
-  ['$__to', '__time_to'],
-  ['$__interval', '__interval'],
-];
+// Macros expanded by the backend. They are kept as-is when interpolating
+// template variables so that Grafana doesn't replace them with its own values.
+const backendMacros = ['__from', '__to', '__interval', '__interval_ms', '__range'];
 
 const columnsVar = '$__columns';
 
 interface ClusterMeta {
   id: string;
   name: string;
+  status?: string;
+  version?: string;
 }
 
 export class DataSource extends DataSourceWithBackend<PixieDataQuery, PixieDataSourceOptions> {
@@ -55,14 +63,19 @@ export class DataSource extends DataSourceWithBackend<PixieDataQuery, PixieDataS
   constructor(instanceSettings: DataSourceInstanceSettings<PixieDataSourceOptions>) {
     super(instanceSettings);
     this.backendSrv = getBackendSrv();
+    // Annotation queries are edited with the query editor and run as annotation scripts.
+    this.annotations = {
+      prepareQuery(anno: AnnotationQuery<PixieDataQuery>) {
+        return anno.target && { ...anno.target, queryType: QueryType.RunAnnotationScript };
+      },
+    };
   }
 
   applyTemplateVariables(query: PixieDataQuery, scopedVars: ScopedVars) {
     let pxlScript = query.queryBody?.pxlScript ?? '';
-
-    // Replace Grafana's time global variables from the script with Pixie's time macros
-    for (const [changeFrom, changeTo] of timeVars) {
-      pxlScript = pxlScript.replaceAll(changeFrom, changeTo);
+    const macroVars: ScopedVars = {};
+    for (const macro of backendMacros) {
+      macroVars[macro] = { text: `$${macro}`, value: `$${macro}` };
     }
 
     // Replace $__columns with columns selected to filter or all columns in script
@@ -91,16 +104,27 @@ export class DataSource extends DataSourceWithBackend<PixieDataQuery, PixieDataS
       ...query,
       queryBody: {
         ...query.queryBody,
-        clusterID: getClusterId() ?? '',
+        ...getClusterIds(getClusterId()),
         pxlScript: pxlScript
           ? getTemplateSrv().replace(pxlScript, {
               ...scopedVars,
+              ...macroVars,
             })
           : '',
       },
     };
   }
 
+  // Lists the PxL script library served by the backend, without the script bodies.
+  async getScripts(): Promise<ScriptInfo[]> {
+    return this.getResource('scripts');
+  }
+
+  // Fetches a single script of the library, e.g. `custom/http-errors`.
+  async getScript(id: string): Promise<ScriptInfo> {
+    return this.getResource(`scripts/${id}`);
+  }
+
   async fetchMetricNames(query: PixieVariableQuery, options: any): Promise<FetchResponse | void> {
     const refId = options?.variable?.name ?? 'tempvar';
 
@@ -192,7 +216,11 @@ export class DataSource extends DataSourceWithBackend<PixieDataQuery, PixieDataS
 
     switch (query.queryType) {
       case QueryType.GetClusters:
-        return this.convertData(flatData, 'name', 'id');
+        // Show why clusters which aren't healthy may not return data.
+        return flatData.map((cluster) => ({
+          text: !cluster.status || cluster.status === 'Healthy' ? cluster.name : `${cluster.name} (${cluster.status})`,
+          value: cluster.id,
+        }));
       case QueryType.GetPods:
         return this.convertData(flatData, undefined, 'pod');
       case QueryType.GetServices:
@@ -202,6 +230,8 @@ export class DataSource extends DataSourceWithBackend<PixieDataQuery, PixieDataS
       case QueryType.GetNodes:
         return this.convertData(flatData, undefined, 'node');
       case QueryType.RunScript:
+      case QueryType.RunTraceScript:
+      case QueryType.RunAnnotationScript:
         return Promise.resolve([]);
       default:
         checkExhaustive(query.queryType);
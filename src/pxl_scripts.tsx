@@ -33,6 +33,8 @@ const namespacesMetrics = require('pxl_scripts/namespaces-metrics.json');
 const serviceMetrics = require('pxl_scripts/service-metrics.json');
 
 export interface Script {
+  // ID of a script of the backend's library, whose body is fetched when it is selected.
+  id?: string;
   name: string;
   description: string;
   script: string;
@@ -59,11 +61,15 @@ const scriptsRaw: Script[] = [
   outboundConnections,
 ];
 
-// Construct options list which is injested by Select component in
-export const scriptOptions: Array<SelectableValue<Script>> = scriptsRaw.map((scriptObject: Script) => ({
-  label: scriptObject.name,
-  description: scriptObject.description,
-  value: scriptObject,
-  columnOptions: (scriptObject.columnNames || []).map((name, index) => ({ label: name, value: index })),
-  groupByColOptions: (scriptObject.groupByColumns || []).map((name, index) => ({ label: name, value: index })),
-}));
+// Construct the option of a script ingested by the Select component
+export function scriptOption(scriptObject: Script): SelectableValue<Script> {
+  return {
+    label: scriptObject.name,
+    description: scriptObject.description,
+    value: scriptObject,
+    columnOptions: (scriptObject.columnNames || []).map((name, index) => ({ label: name, value: index })),
+    groupByColOptions: (scriptObject.groupByColumns || []).map((name, index) => ({ label: name, value: index })),
+  };
+}
+
+export const scriptOptions: Array<SelectableValue<Script>> = scriptsRaw.map(scriptOption);
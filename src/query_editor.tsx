@@ -26,13 +26,32 @@ import 'prismjs/components/prism-python';
 import 'prism-themes/themes/prism-vsc-dark-plus.css';
 import './styles.css';
 import { DataSource } from './datasource';
-import { scriptOptions, Script } from './pxl_scripts';
+import { scriptOptions, scriptOption, Script } from './pxl_scripts';
 import { defaultQuery, PixieDataSourceOptions, PixieDataQuery, QueryType } from './types';
 import { GroupbyComponents } from './groupby';
 import { ColDisplayComponents } from './column_display';
+import { QueryOptionsComponents } from './query_options';
 
 type Props = QueryEditorProps<DataSource, PixieDataQuery, PixieDataSourceOptions>;
 
+interface State {
+  // The clusters visible to the datasource's API key.
+  clusters: Array<SelectableValue<string>>;
+  // The example and custom scripts of the backend's script library, without their body.
+  libraryScripts: Array<SelectableValue<Script>>;
+}
+
+// The query types of scripts: tables or spans shown by Grafana's trace view.
+const scriptQueryTypes: Array<SelectableValue<QueryType>> = [
+  { label: 'Tables', value: QueryType.RunScript },
+  { label: 'Traces', value: QueryType.RunTraceScript },
+];
+
+// scriptQueryType keeps the query type of trace queries when their script changes.
+function scriptQueryType(query: PixieDataQuery): QueryType {
+  return query.queryType === QueryType.RunTraceScript ? QueryType.RunTraceScript : QueryType.RunScript;
+}
+
 const editorStyle = {
   fontFamily: 'Consolas, monaco, monospace',
   fontSize: 12,
@@ -43,23 +62,53 @@ const editorStyle = {
   backgroundColor: 'rgb(18, 18, 18)',
 };
 
-export class QueryEditor extends PureComponent<Props> {
+export class QueryEditor extends PureComponent<Props, State> {
+  state: State = { clusters: [], libraryScripts: [] };
+
+  componentDidMount() {
+    this.loadClusters();
+    this.loadLibraryScripts();
+  }
+
+  async loadClusters() {
+    const clusters = await this.props.datasource.metricFindQuery({ queryType: QueryType.GetClusters });
+    this.setState({ clusters: clusters.map((cluster) => ({ label: cluster.text, value: String(cluster.value) })) });
+  }
+
+  // The bundled scripts of the library are the ones of scriptOptions, so only the example and custom ones are added.
+  async loadLibraryScripts() {
+    const scripts = await this.props.datasource.getScripts();
+    this.setState({
+      libraryScripts: scripts
+        .filter((script) => script.source !== 'bundled')
+        .map((script) => ({
+          label: script.name,
+          description: script.description,
+          value: { id: script.id, name: script.name, description: script.description, script: '' },
+        })),
+    });
+  }
+
   onPxlScriptChange(event: string) {
     const { onChange, query } = this.props;
     onChange({
       ...query,
-      queryType: QueryType.RunScript,
+      queryType: scriptQueryType(query),
       queryBody: { pxlScript: event },
     });
   }
 
-  onScriptSelect(option: SelectableValue<Script>) {
+  async onScriptSelect(option: SelectableValue<Script>) {
+    if (option.value?.id !== undefined) {
+      const script = await this.props.datasource.getScript(option.value.id);
+      option = scriptOption({ ...script, script: script.script ?? '' });
+    }
     if (option.value !== undefined && option.label !== undefined) {
       const { onChange, query, onRunQuery } = this.props;
 
       onChange({
         ...query,
-        queryType: QueryType.RunScript,
+        queryType: scriptQueryType(query),
         queryScript: option,
         queryBody: { pxlScript: option?.value.script ?? '' },
         queryMeta: {
@@ -76,6 +125,21 @@ export class QueryEditor extends PureComponent<Props> {
     }
   }
 
+  onQueryTypeSelect(option: SelectableValue<QueryType>) {
+    if (option.value !== undefined) {
+      const { onChange, query, onRunQuery } = this.props;
+      onChange({ ...query, queryType: option.value });
+      onRunQuery();
+    }
+  }
+
+  // The saved cluster is used when the pixieCluster variable isn't set, as in alert rules.
+  onClusterSelect(option: SelectableValue<string> | null) {
+    const { onChange, query, onRunQuery } = this.props;
+    onChange({ ...query, clusterID: option?.value });
+    onRunQuery();
+  }
+
   render() {
     const query = defaults(this.props.query, defaultQuery);
     const { onChange, onRunQuery } = this.props;
@@ -89,13 +153,39 @@ export class QueryEditor extends PureComponent<Props> {
               Script
             </InlineLabel>
             <Select
-              options={scriptOptions}
+              options={[...scriptOptions, ...this.state.libraryScripts]}
               width={32}
               onChange={this.onScriptSelect.bind(this)}
               defaultValue={query.queryScript ?? scriptOptions[0]}
             />
           </div>
 
+          <div style={{ marginTop: '10px', marginRight: '10px', display: 'flex' }}>
+            <InlineLabel transparent={false} width="auto">
+              Output
+            </InlineLabel>
+            <Select
+              options={scriptQueryTypes}
+              width={16}
+              onChange={this.onQueryTypeSelect.bind(this)}
+              value={scriptQueryType(query)}
+            />
+          </div>
+
+          <div style={{ marginTop: '10px', marginRight: '10px', display: 'flex' }}>
+            <InlineLabel transparent={false} width="auto">
+              Cluster
+            </InlineLabel>
+            <Select
+              options={this.state.clusters}
+              width={24}
+              isClearable={true}
+              placeholder="Default"
+              onChange={this.onClusterSelect.bind(this)}
+              value={query.clusterID ?? null}
+            />
+          </div>
+
           {query.queryMeta?.isColDisplay && (
             <ColDisplayComponents
               datasource={this.props.datasource}
@@ -123,6 +213,13 @@ export class QueryEditor extends PureComponent<Props> {
           </Button>
         </div>
 
+        <QueryOptionsComponents
+          datasource={this.props.datasource}
+          query={query}
+          onRunQuery={onRunQuery}
+          onChange={onChange}
+        />
+
         <Editor
           value={pxlScript ?? ''}
           onValueChange={this.onPxlScriptChange.bind(this)}
@@ -0,0 +1,216 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+import React, { PureComponent } from 'react';
+import { Select, Input, Checkbox, InlineLabel } from '@grafana/ui';
+import { QueryEditorProps, SelectableValue } from '@grafana/data';
+import { config } from '@grafana/runtime';
+import { PixieDataSourceOptions, PixieDataQuery } from './types';
+import { DataSource } from './datasource';
+
+type Props = QueryEditorProps<DataSource, PixieDataQuery, PixieDataSourceOptions>;
+
+type Format = NonNullable<PixieDataQuery['format']>;
+type FillMode = NonNullable<PixieDataQuery['fillMode']>;
+
+const formatOptions: Array<SelectableValue<Format>> = [
+  { label: 'Auto', value: 'auto' },
+  { label: 'Table', value: 'table' },
+  { label: 'Time series (long)', value: 'time_series_long' },
+  { label: 'Time series (wide)', value: 'time_series_wide' },
+  { label: 'Logs', value: 'logs' },
+];
+
+const fillModeOptions: Array<SelectableValue<FillMode>> = [
+  { label: 'Null', value: 'null' },
+  { label: 'Previous', value: 'previous' },
+  { label: 'Value', value: 'value' },
+];
+
+const optionStyle = { marginTop: '10px', marginRight: '10px', display: 'flex' };
+
+// Streamed queries push their results over Grafana Live, which Grafana 8 introduced.
+const liveAvailable = parseInt(config.buildInfo.version, 10) >= 8;
+
+// parseNumber returns the number of a text input, or undefined if it is empty or invalid.
+function parseNumber(value: string): number | undefined {
+  const number = parseFloat(value);
+  return value.trim() === '' || isNaN(number) ? undefined : number;
+}
+
+// parseInteger returns the integer of a text input, or undefined if it is empty or invalid.
+function parseInteger(value: string): number | undefined {
+  const number = parseInt(value, 10);
+  return isNaN(number) ? undefined : number;
+}
+
+// parseList returns the comma-separated values of a text input, or undefined if it is empty.
+function parseList(value: string): string[] | undefined {
+  const values = value
+    .split(',')
+    .map((item) => item.trim())
+    .filter((item) => item !== '');
+  return values.length > 0 ? values : undefined;
+}
+
+// QueryOptionsComponents edits the options of a query which shape its frames
+// and control the execution of its script.
+export class QueryOptionsComponents extends PureComponent<Props> {
+  onOptionChange(option: Partial<PixieDataQuery>) {
+    const { onChange, query, onRunQuery } = this.props;
+    onChange({ ...query, ...option });
+    onRunQuery();
+  }
+
+  // Text options are saved when their input loses focus, so the script
+  // doesn't run on every key press.
+  renderText(label: string, value: string | undefined, onBlur: (value: string) => void, width = 16) {
+    return (
+      <div style={optionStyle}>
+        <InlineLabel transparent={false} width="auto">
+          {label}
+        </InlineLabel>
+        <Input
+          width={width}
+          defaultValue={value ?? ''}
+          onBlur={(e: React.FocusEvent<HTMLInputElement>) => onBlur(e.currentTarget.value)}
+        />
+      </div>
+    );
+  }
+
+  renderCheckbox(label: string, value: boolean | undefined, onChange: (value: boolean) => void) {
+    return (
+      <div style={optionStyle}>
+        <Checkbox
+          label={label}
+          value={value ?? false}
+          onChange={(e: React.FormEvent<HTMLInputElement>) => onChange(e.currentTarget.checked)}
+        />
+      </div>
+    );
+  }
+
+  render() {
+    const { query } = this.props;
+    const format = query.format ?? 'auto';
+    const isTimeSeries = format === 'time_series_long' || format === 'time_series_wide';
+
+    return (
+      <div className="gf-form" style={{ flexWrap: 'wrap' }}>
+        <div style={optionStyle}>
+          <InlineLabel transparent={false} width="auto">
+            Format
+          </InlineLabel>
+          <Select
+            options={formatOptions}
+            width={24}
+            onChange={(option) => this.onOptionChange({ format: option.value })}
+            value={format}
+          />
+        </div>
+
+        {(isTimeSeries || format === 'logs') &&
+          this.renderText('Time column', query.timeColumn, (value) =>
+            this.onOptionChange({ timeColumn: value.trim() || undefined })
+          )}
+        {(isTimeSeries || format === 'logs') &&
+          this.renderText(
+            'Label columns',
+            query.labelColumns?.join(', '),
+            (value) => this.onOptionChange({ labelColumns: parseList(value) }),
+            32
+          )}
+
+        {format === 'time_series_wide' && (
+          <div style={optionStyle}>
+            <InlineLabel transparent={false} width="auto">
+              Fill
+            </InlineLabel>
+            <Select
+              options={fillModeOptions}
+              width={16}
+              isClearable={true}
+              placeholder="None"
+              onChange={(option) => this.onOptionChange({ fillMode: option?.value })}
+              value={query.fillMode ?? null}
+            />
+          </div>
+        )}
+        {format === 'time_series_wide' &&
+          query.fillMode === 'value' &&
+          this.renderText(
+            'Fill value',
+            query.fillValue?.toString(),
+            (value) => this.onOptionChange({ fillValue: parseNumber(value) }),
+            8
+          )}
+
+        {format === 'logs' &&
+          this.renderText('Body column', query.bodyColumn, (value) =>
+            this.onOptionChange({ bodyColumn: value.trim() || undefined })
+          )}
+        {format === 'logs' &&
+          this.renderText('Severity column', query.severityColumn, (value) =>
+            this.onOptionChange({ severityColumn: value.trim() || undefined })
+          )}
+
+        {format === 'auto' &&
+          this.renderText('Nodes table', query.nodesTable, (value) =>
+            this.onOptionChange({ nodesTable: value.trim() || undefined })
+          )}
+        {format === 'auto' &&
+          this.renderText('Edges table', query.edgesTable, (value) =>
+            this.onOptionChange({ edgesTable: value.trim() || undefined })
+          )}
+        {format === 'auto' &&
+          this.renderCheckbox('Derive nodes', query.deriveNodes, (value) =>
+            this.onOptionChange({ deriveNodes: value || undefined })
+          )}
+
+        {this.renderText(
+          'Timeout (s)',
+          query.timeout?.toString(),
+          (value) => this.onOptionChange({ timeout: parseInteger(value) }),
+          8
+        )}
+        {liveAvailable &&
+          this.renderCheckbox('Stream', query.streaming, (value) =>
+            this.onOptionChange({ streaming: value || undefined })
+          )}
+        {liveAvailable &&
+          query.streaming &&
+          this.renderText(
+            'Stream interval (s)',
+            query.streamInterval?.toString(),
+            (value) => this.onOptionChange({ streamInterval: parseInteger(value) }),
+            8
+          )}
+        {this.renderCheckbox('Rates per second', query.ratesPerSecond, (value) =>
+          this.onOptionChange({ ratesPerSecond: value || undefined })
+        )}
+        {this.renderCheckbox('Expand UPIDs', query.expandUPIDs, (value) =>
+          this.onOptionChange({ expandUPIDs: value || undefined })
+        )}
+        {this.renderCheckbox('No cache', query.noCache, (value) =>
+          this.onOptionChange({ noCache: value || undefined })
+        )}
+      </div>
+    );
+  }
+}
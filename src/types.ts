@@ -22,19 +22,28 @@ import { scriptOptions, Script } from './pxl_scripts';
 // Types of available queries to the backend
 export const enum QueryType {
   RunScript = 'run-script',
+  // Lists the id, name, status, version and direct access of the clusters. Their last
+  // heartbeat isn't listed, since Pixie's Go API doesn't expose it.
   GetClusters = 'get-clusters',
   GetPods = 'get-pods',
   GetServices = 'get-services',
   GetNamespaces = 'get-namespaces',
   GetNodes = 'get-nodes',
+  RunTraceScript = 'run-trace-script',
+  RunAnnotationScript = 'run-annotation-script',
 }
 
 // predefined global dashboard variable name for cluster variable
 export const CLUSTER_VARIABLE_NAME = 'pixieCluster';
 
+// cluster ID running a query on every connected cluster
+export const ALL_CLUSTERS = 'all';
+
 // Describes variable query to be sent to the backend.
 export interface PixieVariableQuery {
   queryType: QueryType;
+  // Lists the disconnected clusters in get-clusters queries.
+  includeDisconnected?: boolean;
   queryBody?: {
     clusterID?: string;
   };
@@ -44,12 +53,47 @@ export interface PixieVariableQuery {
 // Pixie queries use PxL, Pixie's query language.
 export interface PixieDataQuery extends DataQuery {
   queryType: QueryType;
+  // Cluster of the query when the pixieCluster variable isn't set, e.g. in alert rules.
   clusterID?: string;
   queryScript?: SelectableValue<Script>;
   queryBody?: {
     clusterID?: string;
+    // Runs the query on each of the clusters, or on every connected cluster for ALL_CLUSTERS.
+    clusterIDs?: string[];
     pxlScript?: string;
   };
+  // Overrides the datasource query timeout, in seconds.
+  timeout?: number;
+  // Pushes the script's results to the panel over Grafana Live.
+  streaming?: boolean;
+  // Time in seconds between two executions of a streamed script.
+  streamInterval?: number;
+  // Adds the agent ID, PID and start time of UPID columns as fields.
+  expandUPIDs?: boolean;
+  // Runs the script without the datasource's response cache.
+  noCache?: boolean;
+  // Shape of the frames: auto, table, time_series_long, time_series_wide or logs.
+  format?: 'auto' | 'table' | 'time_series_long' | 'time_series_wide' | 'logs';
+  // Time column of time series, the first time column if not set.
+  timeColumn?: string;
+  // Columns identifying a time series, every string column if not set, or the labels of logs.
+  labelColumns?: string[];
+  // Fills the missing values of wide time series: null, previous or value.
+  fillMode?: 'null' | 'previous' | 'value';
+  // Value of missing values when fillMode is value.
+  fillValue?: number;
+  // Body of log lines, the other columns as key=value pairs if not set.
+  bodyColumn?: string;
+  // Column of the level of log lines. Status codes are mapped to levels.
+  severityColumn?: string;
+  // Converts throughput columns from rates per nanosecond to rates per second, with a rate unit.
+  ratesPerSecond?: boolean;
+  // Table displayed as the nodes of a node graph, nodes if not set.
+  nodesTable?: string;
+  // Table displayed as the edges of a node graph, edges if not set.
+  edgesTable?: string;
+  // Derives the nodes of a node graph from its edges when there is no nodes table.
+  deriveNodes?: boolean;
   // queryMeta is used for UI-Rendering
   queryMeta?: {
     isColDisplay?: boolean;
@@ -72,6 +116,31 @@ export const defaultQuery: Partial<PixieDataQuery> = {
 export interface PixieDataSourceOptions extends DataSourceJsonData {
   // Address of Pixie cloud.
   cloudAddr?: string;
+  // Maximum number of queries of a single request executed concurrently.
+  maxConcurrentQueries?: number;
+  // Default time in seconds a PxL script may run.
+  queryTimeout?: number;
+  // Number of rows of a table after which its rows are dropped.
+  maxRowsPerTable?: number;
+  // Size in bytes of a table after which its rows are dropped.
+  maxBytesPerTable?: number;
+  // Number of rows of a query after which its script is stopped.
+  maxRowsPerQuery?: number;
+  // Size in bytes of a query's results after which its script is stopped.
+  maxBytesPerQuery?: number;
+  // Time in seconds script responses are cached, 0 to disable the cache.
+  cacheTTL?: number;
+  // Size in bytes of the cached responses after which the least recently used are dropped.
+  cacheMaxBytes?: number;
+}
+
+// ScriptInfo describes a script of the PxL script library served by the backend.
+// Listed scripts don't have a body.
+export interface ScriptInfo extends Omit<Script, 'script'> {
+  id: string;
+  source: 'bundled' | 'example' | 'custom';
+  version: string;
+  script?: string;
 }
 
 export interface PixieSecureDataSourceOptions {
@@ -18,12 +18,12 @@
 
 import { VariableModel } from '@grafana/data';
 import { getTemplateSrv } from '@grafana/runtime';
-import { CLUSTER_VARIABLE_NAME } from 'types';
+import { ALL_CLUSTERS, CLUSTER_VARIABLE_NAME } from 'types';
 
 /**
- * Return the value of the dashboard variable if present.
+ * Return the value of the dashboard variable if present, a list if it has several values.
  */
-export function getClusterId(): string | undefined {
+export function getClusterId(): string | string[] | undefined {
   const dashboardVariables: VariableModel[] = getTemplateSrv().getVariables();
 
   // find cluster variable and convert it to any since the variable value field is not exposed
@@ -31,6 +31,18 @@ export function getClusterId(): string | undefined {
   return pixieClusterIdVariable?.current?.value;
 }
 
+/**
+ * Return the clusters of a query from the value of the dashboard variable: a single
+ * cluster ID, or the cluster IDs of multi-value variables and of their All option.
+ */
+export function getClusterIds(value: string | string[] | undefined): { clusterID: string; clusterIDs?: string[] } {
+  const values = Array.isArray(value) ? value : [value ?? ''];
+  if (values.length === 1 && values[0] !== '$__all') {
+    return { clusterID: values[0] };
+  }
+  return { clusterID: '', clusterIDs: values.map((id) => (id === '$__all' ? ALL_CLUSTERS : id)) };
+}
+
 export function checkExhaustive(val: never): never {
   throw new Error(`Unexpected value: ${JSON.stringify(val)}`);
 }
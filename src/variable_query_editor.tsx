@@ -17,7 +17,7 @@
  */
 
 import { SelectableValue } from '@grafana/data';
-import { Select, Input, Button } from '@grafana/ui';
+import { Select, Input, Button, Checkbox } from '@grafana/ui';
 import React, { useState } from 'react';
 
 import { CLUSTER_VARIABLE_NAME, PixieVariableQuery, QueryType } from './types';
@@ -41,11 +41,14 @@ export const VariableQueryEditor: React.FC<VariableQueryProps> = ({ onChange })
   let [currentValue, setCurrentValue] = useState(valueOptions[0]);
   let clusterIDVariableSet = getClusterId() ? true : false;
   let [clusterID, setClusterID] = useState(clusterIDVariableSet ? `\$${CLUSTER_VARIABLE_NAME}` : '');
+  let [includeDisconnected, setIncludeDisconnected] = useState(false);
 
   const onSubmit = () => {
     let query: PixieVariableQuery = { queryType: currentValue.value! };
     if (query.queryType !== 'get-clusters') {
       query.queryBody = { clusterID: clusterID };
+    } else if (includeDisconnected) {
+      query.includeDisconnected = true;
     }
     onChange(query, currentValue.label!);
   };
@@ -77,6 +80,17 @@ export const VariableQueryEditor: React.FC<VariableQueryProps> = ({ onChange })
           />
         )}
 
+        {currentValue.value === 'get-clusters' && (
+          <Checkbox
+            className="m-2"
+            label="Include disconnected"
+            value={includeDisconnected}
+            onChange={(e) => {
+              setIncludeDisconnected(e.currentTarget.checked);
+            }}
+          />
+        )}
+
         <Button className={currentValue.value === 'get-pods' ? '' : 'm-2'} onClick={onSubmit}>
           Submit
         </Button>
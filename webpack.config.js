@@ -0,0 +1,43 @@
+/*
+ * Copyright 2018- The Pixie Authors.
+ *
+ * Licensed under the Apache License, Version 2.0 (the "License");
+ * you may not use this file except in compliance with the License.
+ * You may obtain a copy of the License at
+ *
+ *     http://www.apache.org/licenses/LICENSE-2.0
+ *
+ * Unless required by applicable law or agreed to in writing, software
+ * distributed under the License is distributed on an "AS IS" BASIS,
+ * WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+ * See the License for the specific language governing permissions and
+ * limitations under the License.
+ *
+ * SPDX-License-Identifier: Apache-2.0
+ */
+
+const fs = require('fs');
+const path = require('path');
+
+// CopyExamplesPlugin copies the example PxL scripts to the examples directory
+// of the bundled scripts, which the backend serves in its script library.
+class CopyExamplesPlugin {
+  apply(compiler) {
+    compiler.hooks.afterEmit.tap('CopyExamplesPlugin', () => {
+      const from = path.resolve(__dirname, 'examples');
+      const to = path.resolve(compiler.options.output.path, 'pxl_scripts', 'examples');
+      fs.mkdirSync(to, { recursive: true });
+      for (const name of fs.readdirSync(from)) {
+        if (path.extname(name) === '.pxl') {
+          fs.copyFileSync(path.join(from, name), path.join(to, name));
+        }
+      }
+    });
+  }
+}
+
+// getWebpackConfig extends the configuration of grafana-toolkit.
+module.exports.getWebpackConfig = (config) => ({
+  ...config,
+  plugins: [...config.plugins, new CopyExamplesPlugin()],
+});